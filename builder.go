@@ -1,10 +1,26 @@
 package kustomizily
 
 import (
+	"bufio"
 	"bytes"
 	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
 	"io"
+	"io/fs"
+	"maps"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"slices"
 	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
 
 	"gopkg.in/yaml.v3"
 )
@@ -14,56 +30,475 @@ import (
 // each generated file (both resource files and kustomization files). Returns an error if
 // any file operation fails or if YAML parsing fails.
 type Builder struct {
-	dirs map[string]*kustomizationBuilder
+	dirs     map[string]*kustomizationBuilder
+	opts     options
+	resolved map[string]struct{}
+	seen     map[string]*k8sObject
+	// inputDir is the directory, relative to the root passed to ProcessDir,
+	// of the file being processed.
+	inputDir   string
+	inInputDir bool
+	// crdScopes maps the group/kind of custom resources to their CRD scope.
+	crdScopes map[string]string
+	// environments holds, by value of their environment label, the resources
+	// held back until Build splits them into the shared base and the overlays.
+	environments map[string][]*k8sObject
+	overlays     map[string]*Builder
+	// generatedAt is the timestamp stamped on the generated resources.
+	generatedAt string
 }
 
 // NewBuilder creates a new Builder instance for handling kustomization operations
-func NewBuilder() *Builder {
-	return &Builder{
-		dirs: map[string]*kustomizationBuilder{"": newKustomizationBuilder()},
+func NewBuilder(opts ...Option) *Builder {
+	b := &Builder{
+		opts:      defaultOptions(),
+		resolved:  map[string]struct{}{},
+		seen:      map[string]*k8sObject{},
+		crdScopes: map[string]string{},
+
+		environments: map[string][]*k8sObject{},
+	}
+	for _, opt := range opts {
+		opt(&b.opts)
 	}
+	b.dirs = map[string]*kustomizationBuilder{"": newKustomizationBuilder("", &b.opts)}
+	return b
 }
 
 // Process reads and processes multi-document YAML manifests from the provided reader.
 // It splits resources into appropriate directories and handles special resource types.
+// A stream starting with a JSON object or array is read as by ProcessJSON.
 func (b *Builder) Process(r io.Reader) error {
+	return b.process(r, b.opts.baseDir)
+}
+
+// ProcessDir processes every *.yaml, *.yml and *.json file found under root, in lexical order.
+// Like with ProcessFile, files already processed as references are skipped.
+// With WithPreserveInputDirs, the resources of each file are routed into the
+// directory of that file relative to root.
+func (b *Builder) ProcessDir(root string) error {
+	return filepath.WalkDir(root, func(name string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+		switch filepath.Ext(name) {
+		case ".yaml", ".yml", ".json":
+		default:
+			return nil
+		}
+
+		rel, err := filepath.Rel(root, filepath.Dir(name))
+		if err != nil {
+			return err
+		}
+		if rel == "." {
+			rel = ""
+		}
+		b.inputDir, b.inInputDir = filepath.ToSlash(rel), true
+		defer func() {
+			b.inputDir, b.inInputDir = "", false
+		}()
+		return b.processFile(name)
+	})
+}
+
+// utf8BOM is the byte order mark some editors, like PowerShell's Out-File, prepend.
+var utf8BOM = []byte{0xEF, 0xBB, 0xBF}
+
+func (b *Builder) process(r io.Reader, baseDir string) error {
+	br := bufio.NewReader(r)
+	if isJSONStream(br) {
+		data, err := io.ReadAll(br)
+		if err != nil {
+			return err
+		}
+		docs, err := decodeJSONDocuments(bytes.NewReader(data))
+		if err != nil {
+			// Not JSON after all, such as a flow-style YAML document
+			// followed by other documents.
+			return b.processYAML(bytes.NewReader(data), baseDir)
+		}
+		return b.processJSONDocuments(docs, baseDir)
+	}
+	return b.processYAML(br, baseDir)
+}
+
+// isJSONStream reports whether the first significant byte of r, after an
+// optional BOM and whitespace, opens a JSON object or array.
+func isJSONStream(r *bufio.Reader) bool {
+	for n := 1; n <= r.Size(); n++ {
+		data, _ := r.Peek(n)
+		if len(data) < n {
+			return false
+		}
+		data = bytes.TrimPrefix(data, utf8BOM)
+		if len(data) == 0 {
+			continue
+		}
+		switch c := data[len(data)-1]; c {
+		case ' ', '\t', '\r', '\n':
+			continue
+		default:
+			return c == '{' || c == '['
+		}
+	}
+	return false
+}
+
+func (b *Builder) processYAML(r io.Reader, baseDir string) error {
 	scanner := newScanner(r)
 
 	for scanner.Scan() {
 		data := scanner.Bytes()
+		data = bytes.TrimPrefix(data, utf8BOM)
 		data = bytes.TrimSpace(data)
 		if len(data) == 0 {
 			continue
 		}
 
-		obj, skip, err := parseYAMLObject(data)
-		if err != nil {
+		if err := b.processInput(data, baseDir); err != nil {
 			return err
 		}
-		if skip {
-			continue
+	}
+	return nil
+}
+
+// ProcessJSON reads and processes a stream of JSON manifests, either objects
+// one after the other or arrays of objects.
+func (b *Builder) ProcessJSON(r io.Reader) error {
+	return b.processJSON(r, b.opts.baseDir)
+}
+
+func (b *Builder) processJSON(r io.Reader, baseDir string) error {
+	docs, err := decodeJSONDocuments(r)
+	if err != nil {
+		return err
+	}
+	return b.processJSONDocuments(docs, baseDir)
+}
+
+// decodeJSONDocuments returns the objects of a stream of JSON objects and
+// arrays of objects.
+func decodeJSONDocuments(r io.Reader) ([]json.RawMessage, error) {
+	br := bufio.NewReader(r)
+	if prefix, _ := br.Peek(len(utf8BOM)); bytes.Equal(prefix, utf8BOM) {
+		br.Discard(len(utf8BOM))
+	}
+	dec := json.NewDecoder(br)
+	var docs []json.RawMessage
+	for {
+		var raw json.RawMessage
+		err := dec.Decode(&raw)
+		if err == io.EOF {
+			return docs, nil
+		}
+		if err != nil {
+			return nil, err
 		}
 
-		obj.Raw = cloneBytes(data)
+		items := []json.RawMessage{raw}
+		if raw[0] == '[' {
+			items = nil
+			if err := json.Unmarshal(raw, &items); err != nil {
+				return nil, err
+			}
+		}
+		for _, item := range items {
+			if item[0] != '{' {
+				return nil, fmt.Errorf("unexpected JSON value, want an object: %.20s", item)
+			}
+			docs = append(docs, item)
+		}
+	}
+}
 
-		if err := b.handleResourceType(&obj); err != nil {
+func (b *Builder) processJSONDocuments(docs []json.RawMessage, baseDir string) error {
+	for _, doc := range docs {
+		if err := b.processInput(doc, baseDir); err != nil {
 			return err
 		}
 	}
 	return nil
 }
 
+// processInput processes a document as read from the input.
+func (b *Builder) processInput(data []byte, baseDir string) error {
+	if b.opts.envSubst {
+		var err error
+		data, err = b.expandEnv(data)
+		if err != nil {
+			return err
+		}
+	}
+	return b.processDocument(data, baseDir)
+}
+
+// processDocument processes a single YAML document read from baseDir.
+func (b *Builder) processDocument(data []byte, baseDir string) error {
+	if b.opts.lenientFieldNames {
+		var err error
+		data, err = normalizeFieldNames(data)
+		if err != nil {
+			return err
+		}
+	}
+
+	obj, skip, err := parseYAMLObject(data)
+	if err != nil {
+		return err
+	}
+	if isKustomization(&obj) {
+		for i := range obj.HelmCharts {
+			b.dirs[""].AddHelmChart(&obj.HelmCharts[i])
+		}
+		if b.opts.resolveReferences {
+			if err := b.resolveReferences(&obj, baseDir); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if strings.HasSuffix(obj.Kind, "List") {
+		items, ok, err := parseListItems(data)
+		if err != nil {
+			return err
+		}
+		if ok {
+			for _, item := range items {
+				if err := b.processDocument(item, baseDir); err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+	}
+	if obj.Kind == "HelmChartInflationGenerator" {
+		chart, err := parseHelmChartInflationGenerator(data)
+		if err != nil {
+			return err
+		}
+		b.dirs[""].AddHelmChart(chart)
+		return nil
+	}
+	if skip {
+		return nil
+	}
+
+	if data[0] == '{' {
+		data, err = toBlockYAML(data)
+		if err != nil {
+			return err
+		}
+	}
+
+	obj.Raw = cloneBytes(data)
+
+	return b.handleResourceType(&obj)
+}
+
 func parseYAMLObject(data []byte) (k8sObject, bool, error) {
 	var obj k8sObject
 	if err := yaml.Unmarshal(data, &obj); err != nil {
 		return k8sObject{}, true, err
 	}
 	if obj.Kind == "" || obj.APIVersion == "" || obj.Metadata.Name == "" {
-		return k8sObject{}, true, nil
+		return obj, true, nil
 	}
 	return obj, false, nil
 }
 
+// parseListItems returns the items of a List document, such as the output of
+// kubectl get -o yaml, as standalone documents. It reports false for
+// documents without an items field.
+func parseListItems(data []byte) ([][]byte, bool, error) {
+	var doc yaml.Node
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return nil, false, err
+	}
+	if len(doc.Content) == 0 || doc.Content[0].Kind != yaml.MappingNode {
+		return nil, false, nil
+	}
+	items := lookupMappingKey(doc.Content[0], "items")
+	if items == nil || items.Kind != yaml.SequenceNode {
+		return nil, false, nil
+	}
+	docs := make([][]byte, 0, len(items.Content))
+	for _, item := range items.Content {
+		itemData, err := encodeYAMLNode(item)
+		if err != nil {
+			return nil, false, err
+		}
+		docs = append(docs, itemData)
+	}
+	return docs, true, nil
+}
+
+// parseHelmChartInflationGenerator converts a HelmChartInflationGenerator
+// document into an entry of a kustomization's helmCharts field.
+func parseHelmChartInflationGenerator(data []byte) (*yaml.Node, error) {
+	var doc yaml.Node
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return nil, err
+	}
+	chart := doc.Content[0]
+	deleteMappingKey(chart, "apiVersion")
+	deleteMappingKey(chart, "kind")
+	deleteMappingKey(chart, "metadata")
+	return chart, nil
+}
+
+// getResourceID identifies a resource by group/version, kind, namespace and name.
+func getResourceID(obj *k8sObject) string {
+	if obj.Metadata.Namespace == "" {
+		return fmt.Sprintf("%s %s %s", obj.APIVersion, obj.Kind, obj.Metadata.Name)
+	}
+	return fmt.Sprintf("%s %s %s/%s", obj.APIVersion, obj.Kind, obj.Metadata.Namespace, obj.Metadata.Name)
+}
+
+var canonicalFieldNames = []string{"apiVersion", "kind", "metadata"}
+
+// normalizeFieldNames renames top-level keys that match apiVersion, kind or
+// metadata case-insensitively to their canonical spelling. The document is
+// returned unchanged when there is nothing to rename.
+func normalizeFieldNames(data []byte) ([]byte, error) {
+	var doc yaml.Node
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return nil, err
+	}
+	if len(doc.Content) == 0 || doc.Content[0].Kind != yaml.MappingNode {
+		return data, nil
+	}
+
+	mapping := doc.Content[0]
+	changed := false
+	for _, name := range canonicalFieldNames {
+		if lookupMappingKey(mapping, name) != nil {
+			continue
+		}
+		for i := 0; i+1 < len(mapping.Content); i += 2 {
+			if strings.EqualFold(mapping.Content[i].Value, name) {
+				mapping.Content[i].Value = name
+				changed = true
+				break
+			}
+		}
+	}
+	if !changed {
+		return data, nil
+	}
+	return encodeYAMLNode(&doc)
+}
+
+var envReferenceRegexp = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)\}|\$([A-Za-z_][A-Za-z0-9_]*)`)
+
+// expandEnv replaces the ${VAR} and $VAR references in data with the values
+// from the configured map or the process environment. Undefined variables
+// are left intact unless strict substitution is enabled.
+func (b *Builder) expandEnv(data []byte) ([]byte, error) {
+	lookup := os.LookupEnv
+	if b.opts.envSubstMap != nil {
+		lookup = func(name string) (string, bool) {
+			value, ok := b.opts.envSubstMap[name]
+			return value, ok
+		}
+	}
+
+	var undefined []string
+	data = envReferenceRegexp.ReplaceAllFunc(data, func(ref []byte) []byte {
+		name := strings.Trim(string(ref), "${}")
+		value, ok := lookup(name)
+		if !ok {
+			undefined = append(undefined, name)
+			return ref
+		}
+		return []byte(value)
+	})
+	if b.opts.envSubstStrict && len(undefined) > 0 {
+		return nil, fmt.Errorf("undefined variables: %s", strings.Join(undefined, ", "))
+	}
+	return data, nil
+}
+
+func isKustomization(obj *k8sObject) bool {
+	return obj.Kind == "Kustomization" && (obj.APIVersion == "" || strings.HasPrefix(obj.APIVersion, "kustomize.config.k8s.io/"))
+}
+
+// isRemoteResource reports whether a kustomization resource is a remote
+// target, such as a git repository or an HTTP URL, rather than a local path.
+func isRemoteResource(resource string) bool {
+	for _, prefix := range []string{"github.com/", "gitlab.com/", "bitbucket.org/", "git@", "git::"} {
+		if strings.HasPrefix(resource, prefix) {
+			return true
+		}
+	}
+	return strings.Contains(resource, "://")
+}
+
+// resolveReferences processes the files referenced by a Kustomization's resources
+// relative to baseDir. Directories are resolved through their kustomization.yaml,
+// and references that are not available on disk are ignored.
+func (b *Builder) resolveReferences(obj *k8sObject, baseDir string) error {
+	for _, resource := range obj.Resources {
+		if isRemoteResource(resource) {
+			continue
+		}
+
+		name := filepath.Join(baseDir, filepath.FromSlash(resource))
+		info, err := os.Stat(name)
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return err
+		}
+		if info.IsDir() {
+			name = filepath.Join(name, "kustomization.yaml")
+			if _, err := os.Stat(name); err != nil {
+				if os.IsNotExist(err) {
+					continue
+				}
+				return err
+			}
+		}
+
+		if err := b.processFile(name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ProcessFile processes a YAML file, or a JSON one when named *.json,
+// resolving references relative to its directory. Files already processed,
+// directly or as references, are skipped.
+func (b *Builder) ProcessFile(name string) error {
+	return b.processFile(name)
+}
+
+func (b *Builder) processFile(name string) error {
+	abs, err := filepath.Abs(name)
+	if err != nil {
+		return err
+	}
+	if _, ok := b.resolved[abs]; ok {
+		return nil
+	}
+	b.resolved[abs] = struct{}{}
+
+	f, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if filepath.Ext(name) == ".json" {
+		return b.processJSON(f, filepath.Dir(name))
+	}
+	return b.process(f, filepath.Dir(name))
+}
+
 func cloneBytes(data []byte) []byte {
 	clone := make([]byte, len(data))
 	copy(clone, data)
@@ -71,53 +506,720 @@ func cloneBytes(data []byte) []byte {
 }
 
 func (b *Builder) Build(writeFile func(dir string, name string, data []byte) error) error {
-	sortedDirs := make([]string, 0, len(b.dirs))
-	for dir := range b.dirs {
-		sortedDirs = append(sortedDirs, dir)
+	if err := b.opts.validate(); err != nil {
+		return err
+	}
+
+	previous := b.opts.previousOutput
+	if previous == nil {
+		return b.buildOutput(writeFile)
+	}
+	mem := NewMemFS()
+	var files []outputFile
+	err := b.buildOutput(func(dir string, name string, data []byte) error {
+		files = append(files, outputFile{dir: dir, name: name})
+		return mem.WriteFile(dir, name, data)
+	})
+	if err != nil {
+		return err
+	}
+	return writeChangedDirs(mem, files, previous, b.opts.skippedFile, writeFile)
+}
+
+// outputFile is a file passed to the writeFile of Build.
+type outputFile struct {
+	dir  string
+	name string
+}
+
+// writeChangedDirs writes the files of mem, in the order of files, leaving
+// out the directories whose files all have the same content in previous.
+func writeChangedDirs(mem *MemFS, files []outputFile, previous fs.FS, skipped func(dir string, name string), writeFile func(dir string, name string, data []byte) error) error {
+	changed := map[string]bool{}
+	for _, file := range files {
+		data, err := fs.ReadFile(previous, path.Join(file.dir, file.name))
+		if err != nil || !bytes.Equal(data, mem.Data[path.Join(file.dir, file.name)]) {
+			changed[file.dir] = true
+		}
+	}
+
+	written := map[outputFile]struct{}{}
+	for _, file := range files {
+		if _, ok := written[file]; ok {
+			continue
+		}
+		written[file] = struct{}{}
+		if !changed[file.dir] {
+			if skipped != nil {
+				skipped(file.dir, file.name)
+			}
+			continue
+		}
+		if err := writeFile(file.dir, file.name, mem.Data[path.Join(file.dir, file.name)]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (b *Builder) buildOutput(writeFile func(dir string, name string, data []byte) error) error {
+	if b.opts.lineEnding == "crlf" {
+		write := writeFile
+		writeFile = func(dir string, name string, data []byte) error {
+			return write(dir, name, b.opts.convertLineEndings(data))
+		}
+	}
+
+	if base := b.opts.remoteBase; base != "" && !slices.Contains(b.ensureDirExists("").resources, base) {
+		b.dirs[""].AddResource(base)
+	}
+
+	fluxPath := "./"
+	switch overlay := b.opts.namespacedOverlay; {
+	case overlay != nil:
+		err := b.build(func(dir string, name string, data []byte) error {
+			return writeFile(path.Join(overlayBaseDir, dir), name, data)
+		})
+		if err != nil {
+			return err
+		}
+		err = writeFile(overlayDir, "kustomization.yaml", buildOverlayKustomization(overlay.namespace, overlay.namePrefix, b.opts.sortOrder))
+		if err != nil {
+			return err
+		}
+		fluxPath = "./" + overlayDir
+	case b.opts.sharedBase != "":
+		if err := b.buildSharedBase(writeFile); err != nil {
+			return err
+		}
+		fluxPath = "./" + b.opts.sharedBase
+	default:
+		if err := b.build(writeFile); err != nil {
+			return err
+		}
+	}
+
+	if flux := b.opts.fluxKustomization; flux != nil {
+		return writeFile("", fluxKustomizationFilename, buildFluxKustomization(flux, fluxPath))
+	}
+	return nil
+}
+
+// convertLineEndings returns data with the line endings set by
+// WithLineEnding. Binary data is returned unchanged.
+func (o *options) convertLineEndings(data []byte) []byte {
+	if o.lineEnding != "crlf" || isBinary(data) {
+		return data
+	}
+	return toCRLF(data)
+}
+
+// toCRLF converts the line endings of data to CRLF.
+func toCRLF(data []byte) []byte {
+	data = bytes.ReplaceAll(data, []byte("\r\n"), []byte("\n"))
+	return bytes.ReplaceAll(data, []byte("\n"), []byte("\r\n"))
+}
+
+// BuildTo builds like Build but writes all files to w as a single
+// multi-document stream, each file preceded by a "# --- dir/name ---" banner.
+func (b *Builder) BuildTo(w io.Writer) error {
+	first := true
+	return b.Build(func(dir string, name string, data []byte) error {
+		var buf bytes.Buffer
+		if !first {
+			buf.WriteString("---\n")
+		}
+		first = false
+		fmt.Fprintf(&buf, "# --- %s ---\n", path.Join(dir, name))
+		buf.Write(data)
+		if len(data) > 0 && data[len(data)-1] != '\n' {
+			buf.WriteString("\n")
+		}
+		_, err := w.Write(buf.Bytes())
+		return err
+	})
+}
+
+const (
+	environmentLabel = "environment"
+	overlaysDir      = "overlays"
+)
+
+// buildSharedBase writes the resources shared by all environments under the
+// shared base dir, and the other ones under overlays/<environment>, each
+// overlay including the shared base.
+func (b *Builder) buildSharedBase(writeFile func(dir string, name string, data []byte) error) error {
+	if b.overlays == nil {
+		overlays, err := b.splitEnvironments()
+		if err != nil {
+			return err
+		}
+		b.overlays = overlays
+	}
+
+	err := b.build(func(dir string, name string, data []byte) error {
+		return writeFile(path.Join(b.opts.sharedBase, dir), name, data)
+	})
+	if err != nil {
+		return err
+	}
+
+	envs := make([]string, 0, len(b.overlays))
+	for env := range b.overlays {
+		envs = append(envs, env)
+	}
+	sort.Strings(envs)
+	for _, env := range envs {
+		dir := path.Join(overlaysDir, env)
+		err := b.overlays[env].build(func(subdir string, name string, data []byte) error {
+			return writeFile(path.Join(dir, subdir), name, data)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// splitEnvironments routes the resources held back by environment. Those
+// present with identical content in all environments go to the shared base
+// without their environment label, the other ones to a Builder per environment.
+func (b *Builder) splitEnvironments() (map[string]*Builder, error) {
+	type variant struct {
+		obj  *k8sObject
+		data []byte
+	}
+	variants := map[string][]variant{}
+	ids := []string{}
+	for env, objects := range b.environments {
+		for _, obj := range objects {
+			data, err := stripLabels(obj.Raw, map[string]string{environmentLabel: env})
+			if err != nil {
+				return nil, err
+			}
+			id := getResourceID(obj)
+			if _, ok := variants[id]; !ok {
+				ids = append(ids, id)
+			}
+			variants[id] = append(variants[id], variant{obj: obj, data: data})
+		}
+	}
+	sort.Strings(ids)
+
+	overlays := map[string]*Builder{}
+	for env := range b.environments {
+		overlay := b.newEnvironmentBuilder()
+		overlay.dirs[""].AddResource(path.Join("../..", b.opts.sharedBase))
+		overlays[env] = overlay
+	}
+	for _, id := range ids {
+		vs := variants[id]
+		shared := len(vs) == len(b.environments)
+		for _, v := range vs[1:] {
+			if !bytes.Equal(v.data, vs[0].data) {
+				shared = false
+				break
+			}
+		}
+		if shared {
+			obj := vs[0].obj
+			obj.Raw = vs[0].data
+			delete(obj.Metadata.Labels, environmentLabel)
+			if err := b.handleResourceType(obj); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		for _, v := range vs {
+			env := v.obj.Metadata.Labels[environmentLabel]
+			if err := overlays[env].handleResourceType(v.obj); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return overlays, nil
+}
+
+// newEnvironmentBuilder returns a Builder for the resources of an overlay,
+// sharing the options and known CRD scopes.
+func (b *Builder) newEnvironmentBuilder() *Builder {
+	env := &Builder{
+		opts:         b.opts,
+		resolved:     map[string]struct{}{},
+		seen:         map[string]*k8sObject{},
+		crdScopes:    b.crdScopes,
+		environments: map[string][]*k8sObject{},
+	}
+	env.opts.sharedBase = ""
+	env.opts.fluxKustomization = nil
+	env.dirs = map[string]*kustomizationBuilder{"": newKustomizationBuilder("", &env.opts)}
+	return env
+}
+
+func (b *Builder) build(writeFile func(dir string, name string, data []byte) error) error {
+	if b.opts.autoLayoutThreshold > 0 {
+		b.applyAutoLayout(b.opts.autoLayoutThreshold)
+	}
+
+	if b.opts.collapseSingletonDirs {
+		b.collapseSingletonDirs()
+	}
+
+	// Shared kustomizations hold a single object, so this comes after
+	// collapseSingletonDirs to keep them.
+	if b.opts.contentDedupDir != "" {
+		b.dedupContent(b.opts.contentDedupDir)
 	}
-	sort.Strings(sortedDirs)
 
-	for _, dir := range sortedDirs {
+	if !b.opts.keepEmptyDirs {
+		b.dropEmptyDirs()
+	}
+
+	binaryFiles := []string{}
+	graphFiles := map[string][]string{}
+	for _, dir := range b.sortedDirs() {
 		err := b.dirs[dir].Build(func(name string, data []byte) error {
-			return writeFile(dir, name, data)
+			if b.opts.fluxKustomization != nil && b.opts.namespacedOverlay == nil && b.opts.sharedBase == "" {
+				if dir == "" && name == fluxKustomizationFilename {
+					return fmt.Errorf("file %q conflicts with the generated Flux Kustomization", name)
+				}
+			}
+			if b.opts.gitAttributes {
+				if dir == "" && name == gitAttributesFilename {
+					return fmt.Errorf("file %q conflicts with the generated %s", name, gitAttributesFilename)
+				}
+				if isBinary(data) {
+					binaryFiles = append(binaryFiles, path.Join(dir, name))
+				}
+			}
+			if b.opts.treeGraph {
+				if dir == "" && name == treeGraphFilename {
+					return fmt.Errorf("file %q conflicts with the generated %s", name, treeGraphFilename)
+				}
+				if name != "kustomization.yaml" {
+					graphFiles[dir] = append(graphFiles[dir], name)
+				}
+			}
+			subdir, name := path.Split(name)
+			return writeFile(path.Join(dir, subdir), name, data)
 		})
 		if err != nil {
 			return err
 		}
 	}
+
+	if b.opts.gitAttributes {
+		if err := writeFile("", gitAttributesFilename, buildGitAttributes(binaryFiles)); err != nil {
+			return err
+		}
+	}
+	if b.opts.treeGraph {
+		if err := writeFile("", treeGraphFilename, buildTreeGraph(b.sortedDirs(), graphFiles)); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
+const treeGraphFilename = "structure.dot"
+
+// buildTreeGraph renders the output directories and the files written into
+// each of them as a Graphviz DOT graph, with edges from a directory to what
+// it contains.
+func buildTreeGraph(dirs []string, files map[string][]string) []byte {
+	id := func(name string) string {
+		if name == "" {
+			return `"."`
+		}
+		return strconv.Quote(name)
+	}
+	var buf bytes.Buffer
+	buf.WriteString("digraph structure {\n")
+	for _, dir := range dirs {
+		label := path.Base(dir)
+		if dir == "" {
+			label = "."
+		}
+		fmt.Fprintf(&buf, "  %s [shape=folder, label=%s];\n", id(dir), strconv.Quote(label))
+		if dir != "" {
+			fmt.Fprintf(&buf, "  %s -> %s;\n", id(parentDir(dir)), id(dir))
+		}
+		names := slices.Clone(files[dir])
+		sort.Strings(names)
+		for _, name := range names {
+			file := path.Join(dir, name)
+			fmt.Fprintf(&buf, "  %s [shape=note, label=%s];\n", id(file), strconv.Quote(name))
+			fmt.Fprintf(&buf, "  %s -> %s;\n", id(dir), id(file))
+		}
+	}
+	buf.WriteString("}\n")
+	return buf.Bytes()
+}
+
+const gitAttributesFilename = ".gitattributes"
+
+// buildGitAttributes marks the given files as binary so git doesn't diff them as text.
+func buildGitAttributes(binaryFiles []string) []byte {
+	sort.Strings(binaryFiles)
+	var buf bytes.Buffer
+	for _, name := range binaryFiles {
+		fmt.Fprintf(&buf, "/%s binary\n", name)
+	}
+	return buf.Bytes()
+}
+
+// dropEmptyDirs removes directories that ended up without any content
+// along with their reference in the root kustomization.
+func (b *Builder) dropEmptyDirs() {
+	// Children come first, so a parent left empty by them is dropped too.
+	dirs := b.sortedDirs()
+	for i := len(dirs) - 1; i >= 0; i-- {
+		dir := dirs[i]
+		kustomization, ok := b.dirs[dir]
+		if dir == "" || !ok || !kustomization.IsEmpty() {
+			continue
+		}
+		delete(b.dirs, dir)
+		if parent, ok := b.dirs[parentDir(dir)]; ok {
+			parent.RemoveResource(path.Base(dir))
+		}
+	}
+}
+
+// applyAutoLayout splits directories holding more than threshold resources
+// of mixed kinds into one subdirectory per kind.
+func (b *Builder) applyAutoLayout(threshold int) {
+	for _, dir := range b.sortedDirs() {
+		kustomization := b.dirs[dir]
+		if dir == "" || len(kustomization.k8sObjects) <= threshold || !hasMixedKinds(kustomization.k8sObjects) {
+			continue
+		}
+		objects := kustomization.k8sObjects
+		kustomization.k8sObjects = nil
+		for _, obj := range objects {
+			b.ensureDirExists(path.Join(dir, strings.ToLower(obj.Kind))).AddK8sObject(obj)
+		}
+	}
+}
+
+// dedupContent moves resources found in several directories with the same
+// content, apart from their name and namespace, into a kustomization of their
+// own under sharedDir. The copy written there has no namespace, and each
+// directory references it with a patch setting its own name and namespace,
+// so a common parent still builds every resource once. sharedDir itself is
+// not referenced.
+func (b *Builder) dedupContent(sharedDir string) {
+	type copyOf struct {
+		dir string
+		obj *k8sObject
+	}
+	copies := map[string][]copyOf{}
+	contents := []string{}
+	for _, dir := range b.sortedDirs() {
+		if dir == sharedDir || strings.HasPrefix(dir, sharedDir+"/") {
+			continue
+		}
+		for _, obj := range b.dirs[dir].k8sObjects {
+			data, err := editYAML(obj.Raw, func(node *yaml.Node) bool {
+				metadata := lookupMappingKey(node, "metadata")
+				name := deleteMappingKey(metadata, "name")
+				namespace := deleteMappingKey(metadata, "namespace")
+				return name || namespace
+			})
+			if err != nil {
+				continue
+			}
+			content := string(data)
+			if _, ok := copies[content]; !ok {
+				contents = append(contents, content)
+			}
+			copies[content] = append(copies[content], copyOf{dir: dir, obj: obj})
+		}
+	}
+
+	for _, content := range contents {
+		cs := copies[content]
+		first := cs[0].obj
+		group := path.Join(sharedDir, strings.TrimSuffix(getK8sObjectShortFilenameByNameAndKind(first), ".yaml"))
+		if _, ok := b.dirs[group]; ok {
+			continue
+		}
+		// A directory can reference a shared kustomization once, and its
+		// patch finds the shared copy by name, so the name must not be
+		// taken by another of the directory's objects.
+		dirs := map[string]struct{}{}
+		shareable := len(cs) > 1
+		for _, c := range cs {
+			if _, ok := dirs[c.dir]; ok || b.dirs[c.dir].hasObjectNamed(first.Kind, first.Metadata.Name, c.obj) {
+				shareable = false
+				break
+			}
+			dirs[c.dir] = struct{}{}
+		}
+		if !shareable {
+			continue
+		}
+
+		raw, err := editYAML(first.Raw, func(node *yaml.Node) bool {
+			return deleteMappingKey(lookupMappingKey(node, "metadata"), "namespace")
+		})
+		if err != nil {
+			continue
+		}
+		shared := *first
+		shared.Raw = raw
+		shared.Metadata.Namespace = ""
+
+		if _, ok := b.dirs[sharedDir]; !ok {
+			b.ensureDirExists(sharedDir)
+			b.dirs[parentDir(sharedDir)].RemoveResource(path.Base(sharedDir))
+		}
+		b.ensureDirExists(group).AddK8sObject(&shared)
+		for _, c := range cs {
+			kustomization := b.dirs[c.dir]
+			kustomization.RemoveObject(c.obj)
+			kustomization.AddSharedObject(relativeDir(c.dir, group), &shared, c.obj)
+		}
+	}
+}
+
+// relativeDir returns the path of the output directory target relative to dir.
+func relativeDir(dir, target string) string {
+	rel, _ := filepath.Rel(filepath.FromSlash("/"+dir), filepath.FromSlash("/"+target))
+	return filepath.ToSlash(rel)
+}
+
+// collapseSingletonDirs moves the resource of directories holding a single
+// resource and nothing else into the parent directory, with the directory
+// name prefixed to its filename, and removes the directory.
+func (b *Builder) collapseSingletonDirs() {
+	dirs := b.sortedDirs()
+	for i := len(dirs) - 1; i >= 0; i-- {
+		dir := dirs[i]
+		kustomization := b.dirs[dir]
+		if dir == "" || kustomization.component || len(kustomization.k8sObjects) != 1 {
+			continue
+		}
+		obj := kustomization.k8sObjects[0]
+		kustomization.k8sObjects = nil
+		if !kustomization.IsEmpty() {
+			kustomization.k8sObjects = []*k8sObject{obj}
+			continue
+		}
+
+		if obj.Filename == "" {
+			fun, _ := selectUniqueFilenameFuncForK8sObjects([]*k8sObject{obj}, map[string]struct{}{}, k8sObjectFilenameFuncs)
+			obj.Filename = fun(obj)
+		}
+		obj.Filename = path.Base(dir) + "_" + obj.Filename
+
+		delete(b.dirs, dir)
+		parent := b.dirs[parentDir(dir)]
+		parent.RemoveResource(path.Base(dir))
+		parent.AddK8sObject(obj)
+	}
+}
+
+func hasMixedKinds(objects []*k8sObject) bool {
+	for _, obj := range objects[1:] {
+		if obj.Kind != objects[0].Kind {
+			return true
+		}
+	}
+	return false
+}
+
+func (b *Builder) sortedDirs() []string {
+	dirs := make([]string, 0, len(b.dirs))
+	for dir := range b.dirs {
+		dirs = append(dirs, dir)
+	}
+	sort.Strings(dirs)
+	return dirs
+}
+
+func parentDir(dir string) string {
+	parent := path.Dir(dir)
+	if parent == "." {
+		return ""
+	}
+	return parent
+}
+
 func (b *Builder) getKustomization(obj *k8sObject) *kustomizationBuilder {
-	dir := getTargetDir(obj)
+	return b.ensureDirExists(b.targetDir(obj))
+}
+
+// ensureDirExists returns the kustomization for dir, creating it and
+// referencing it from its parent directories as needed.
+func (b *Builder) ensureDirExists(dir string) *kustomizationBuilder {
 	if _, exists := b.dirs[dir]; !exists {
-		b.dirs[dir] = newKustomizationBuilder()
-		b.dirs[""].AddResource(dir)
+		b.dirs[dir] = newKustomizationBuilder(dir, &b.opts)
+		b.ensureDirExists(parentDir(dir)).AddResource(path.Base(dir))
 	}
 	return b.dirs[dir]
 }
 
-func getTargetDir(obj *k8sObject) string {
-	if obj.APIVersion == "apiextensions.k8s.io/v1" && obj.Kind == "CustomResourceDefinition" {
+// targetDir returns the directory obj is routed to, applying the
+// configured routing overrides before the default label-based grouping.
+func (b *Builder) targetDir(obj *k8sObject) string {
+	if b.opts.flatLayout {
+		return ""
+	}
+	if b.opts.preserveInputDirs && b.inInputDir {
+		return b.inputDir
+	}
+	if b.opts.configDir != "" && (obj.APIVersion == "v1" && (obj.Kind == "ConfigMap" || obj.Kind == "Secret") || slices.Contains(b.opts.treatAsGenerator, obj.Kind)) {
+		return b.opts.configDir
+	}
+	if b.opts.clusterScopedDir != "" && b.crdScopes[getGroupKind(obj)] == "Cluster" {
+		return b.opts.clusterScopedDir
+	}
+	dir := b.groupDir(obj)
+	if b.opts.layoutStrategy == LayoutByNamespace && obj.Metadata.Namespace != "" {
+		return path.Join(obj.Metadata.Namespace, dir)
+	}
+	return dir
+}
+
+// groupDir returns the directory grouping obj with related resources.
+func (b *Builder) groupDir(obj *k8sObject) string {
+	if b.opts.groupNetworking && (slices.Contains(defaultNetworkingKinds, obj.Kind) || slices.Contains(b.opts.networkingKinds, obj.Kind)) {
+		return networkingDir
+	}
+	if b.opts.groupBatch && (slices.Contains(defaultBatchKinds, obj.Kind) || slices.Contains(b.opts.batchKinds, obj.Kind)) {
+		return batchDir
+	}
+	if b.opts.groupByChart {
+		if chart := getChartName(obj.Metadata.Labels["helm.sh/chart"]); chart != "" {
+			return chart
+		}
+	}
+	return getTargetDir(obj, b.opts.routingLabels)
+}
+
+const networkingDir = "networking"
+
+// defaultNetworkingKinds are the kinds routed by WithGroupNetworking, covering
+// Ingress, the Gateway API and Istio.
+var defaultNetworkingKinds = []string{
+	"Ingress",
+	"IngressClass",
+	"Gateway",
+	"GatewayClass",
+	"HTTPRoute",
+	"GRPCRoute",
+	"TCPRoute",
+	"TLSRoute",
+	"UDPRoute",
+	"ReferenceGrant",
+	"VirtualService",
+	"DestinationRule",
+	"ServiceEntry",
+}
+
+const batchDir = "batch"
+
+// defaultBatchKinds are the kinds routed by WithGroupBatch.
+var defaultBatchKinds = []string{
+	"Job",
+	"CronJob",
+}
+
+var chartVersionRegexp = regexp.MustCompile(`^(.+?)-v?[0-9]+\.[0-9]+`)
+
+// getChartName strips the version from a helm.sh/chart label value,
+// e.g. "ingress-nginx-4.0.1" becomes "ingress-nginx".
+func getChartName(chart string) string {
+	if m := chartVersionRegexp.FindStringSubmatch(chart); m != nil {
+		return m[1]
+	}
+	return chart
+}
+
+func getGroupKind(obj *k8sObject) string {
+	group := ""
+	if i := strings.LastIndex(obj.APIVersion, "/"); i >= 0 {
+		group = obj.APIVersion[:i]
+	}
+	return group + "/" + obj.Kind
+}
+
+func isCRD(obj *k8sObject) bool {
+	return obj.APIVersion == "apiextensions.k8s.io/v1" && obj.Kind == "CustomResourceDefinition"
+}
+
+func getTargetDir(obj *k8sObject, routingLabels []string) string {
+	if isCRD(obj) {
 		return "crd"
 	}
 
-	labels := obj.Metadata.Labels
-	switch {
-	case labels["app.kubernetes.io/component"] != "":
-		return labels["app.kubernetes.io/component"]
-	case labels["component"] != "":
-		return labels["component"]
-	case labels["app.kubernetes.io/name"] != "":
-		return labels["app.kubernetes.io/name"]
-	case labels["app"] != "":
-		return labels["app"]
-	default:
-		return ""
+	for _, key := range routingLabels {
+		if value := obj.Metadata.Labels[key]; value != "" {
+			return value
+		}
 	}
+	return ""
+}
+
+// defaultRoutingLabels are the label keys, in order of priority, whose value
+// names the directory of a resource.
+var defaultRoutingLabels = []string{
+	"app.kubernetes.io/component",
+	"component",
+	"app.kubernetes.io/name",
+	"app",
 }
 
 func (b *Builder) handleResourceType(obj *k8sObject) error {
+	if isCRD(obj) && obj.Spec.Names.Kind != "" {
+		b.crdScopes[obj.Spec.Group+"/"+obj.Spec.Names.Kind] = obj.Spec.Scope
+	}
+
+	if b.opts.sharedBase != "" {
+		if env := obj.Metadata.Labels[environmentLabel]; env != "" {
+			b.environments[env] = append(b.environments[env], obj)
+			return nil
+		}
+	}
+
+	if b.opts.duplicatePolicy != DuplicateKeepAll {
+		id := getResourceID(obj)
+		if prev, ok := b.seen[id]; ok {
+			switch b.opts.duplicatePolicy {
+			case DuplicateError:
+				return fmt.Errorf("duplicate resource %s", id)
+			case DuplicateKeepFirst:
+				return nil
+			case DuplicateKeepLast:
+				for _, k := range b.dirs {
+					k.RemoveObject(prev)
+				}
+			}
+		}
+		b.seen[id] = obj
+	}
+
+	if kind, ok := obj.Metadata.Annotations[kindAnnotation]; ok {
+		if kind == "Component" {
+			b.markComponent(b.targetDir(obj))
+		}
+		if err := consumeAnnotation(obj, kindAnnotation); err != nil {
+			return err
+		}
+	}
+
+	if spec, ok := obj.Metadata.Annotations[replacementAnnotation]; ok {
+		data, err := parseReplacement(spec)
+		if err != nil {
+			return fmt.Errorf("invalid %s annotation on %s %s: %w", replacementAnnotation, obj.Kind, obj.Metadata.Name, err)
+		}
+		b.getKustomization(obj).AddReplacement(obj, data)
+		if err := consumeAnnotation(obj, replacementAnnotation); err != nil {
+			return err
+		}
+	}
+
 	switch {
 	case obj.APIVersion == "v1" && obj.Kind == "ConfigMap":
 		return b.handleConfigMap(obj)
@@ -128,28 +1230,162 @@ func (b *Builder) handleResourceType(obj *k8sObject) error {
 	}
 }
 
+const (
+	kindAnnotation        = "kustomizily.io/kind"
+	replacementAnnotation = "kustomizily.io/replacement"
+	// asEnvAnnotation set to "true" writes the single-line values of a
+	// ConfigMap as one env file, listed under envs of its generator.
+	asEnvAnnotation = "kustomizily.io/as-env"
+)
+
+// consumeAnnotation removes the annotation key, which only instructs the
+// Builder, from obj so that it isn't written out.
+func consumeAnnotation(obj *k8sObject, key string) error {
+	delete(obj.Metadata.Annotations, key)
+	raw, err := stripAnnotations(obj.Raw, key)
+	if err != nil {
+		return err
+	}
+	obj.Raw = raw
+	return nil
+}
+
+// markComponent turns dir into a kustomize Component, referenced from its
+// parent under components instead of resources.
+func (b *Builder) markComponent(dir string) {
+	if dir == "" {
+		return
+	}
+	b.ensureDirExists(dir).SetComponent(true)
+	b.dirs[parentDir(dir)].MoveResourceToComponents(path.Base(dir))
+}
+
+// parseReplacement validates a JSON/YAML-encoded kustomize replacement spec
+// and returns it as block-style YAML.
+func parseReplacement(spec string) ([]byte, error) {
+	var replacement struct {
+		Source  map[string]any `yaml:"source"`
+		Targets []any          `yaml:"targets"`
+	}
+	if err := yaml.Unmarshal([]byte(spec), &replacement); err != nil {
+		return nil, err
+	}
+	if len(replacement.Source) == 0 {
+		return nil, fmt.Errorf("missing source")
+	}
+	if len(replacement.Targets) == 0 {
+		return nil, fmt.Errorf("missing targets")
+	}
+	return toBlockYAML([]byte(spec))
+}
+
 func (b *Builder) handleConfigMap(obj *k8sObject) error {
 	fileGroup := &filesObject{
 		k8sObject: obj,
 		files:     make(map[string][]byte),
 	}
 
-	for key, value := range obj.Data {
+	asEnv := obj.Metadata.Annotations[asEnvAnnotation] == "true"
+	if asEnv {
+		delete(obj.Metadata.Annotations, asEnvAnnotation)
+	}
+	envKey := obj.Metadata.Name + ".env"
+	if _, ok := obj.Data[envKey]; ok {
+		asEnv = false
+	}
+	var env bytes.Buffer
+
+	keys := make([]string, 0, len(obj.Data))
+	for key := range obj.Data {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		value := obj.Data[key]
+		if asEnv && !strings.ContainsAny(value, "\r\n") && utf8.ValidString(value) {
+			fmt.Fprintf(&env, "%s=%s\n", key, value)
+			continue
+		}
+		if b.opts.recursiveConfigMapSplit {
+			docs, ok, err := splitEmbeddedManifests(value)
+			if err != nil {
+				return err
+			}
+			if ok {
+				for _, doc := range docs {
+					if err := b.processDocument(doc, b.opts.baseDir); err != nil {
+						return err
+					}
+				}
+				continue
+			}
+		}
+		if b.isLiteral(value) {
+			if fileGroup.literals == nil {
+				fileGroup.literals = map[string]string{}
+			}
+			fileGroup.literals[key] = value
+			continue
+		}
 		fileGroup.files[key] = []byte(value)
 	}
 
 	for key, value := range obj.BinaryData {
-		data, err := base64.StdEncoding.DecodeString(value)
+		data, err := decodeBase64(value)
 		if err != nil {
-			return err
+			return fmt.Errorf("configmap %s: invalid base64 in binaryData key %q: %w", obj.Metadata.Name, key, err)
 		}
 		fileGroup.files[key] = data
 	}
 
+	if env.Len() > 0 {
+		fileGroup.envKey = envKey
+		fileGroup.files[envKey] = env.Bytes()
+	}
+
 	b.getKustomization(obj).AddConfigMapObjects(fileGroup)
 	return nil
 }
 
+// isLiteral reports whether a ConfigMap value is short enough to be written
+// inline as a generator literal. Values kustomize would alter when parsing a
+// literal, such as quoted or space-padded ones, are kept as files.
+func (b *Builder) isLiteral(value string) bool {
+	if b.opts.literalThreshold <= 0 || len(value) > b.opts.literalThreshold || !utf8.ValidString(value) {
+		return false
+	}
+	if strings.ContainsAny(value, "\r\n") || strings.TrimSpace(value) != value {
+		return false
+	}
+	if len(value) >= 2 && (value[0] == '"' || value[0] == '\'') && value[len(value)-1] == value[0] {
+		return false
+	}
+	return true
+}
+
+// splitEmbeddedManifests returns the documents of a ConfigMap value holding
+// Kubernetes manifests. It reports false unless every document of the value
+// is a resource with an apiVersion, kind and name, so other YAML is kept.
+func splitEmbeddedManifests(value string) ([][]byte, bool, error) {
+	var docs [][]byte
+	scanner := newScanner(strings.NewReader(value))
+	for scanner.Scan() {
+		data := bytes.TrimSpace(scanner.Bytes())
+		if len(data) == 0 {
+			continue
+		}
+		obj, skip, err := parseYAMLObject(data)
+		if err != nil || skip || isKustomization(&obj) {
+			return nil, false, nil
+		}
+		docs = append(docs, cloneBytes(data))
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, false, err
+	}
+	return docs, len(docs) > 0, nil
+}
+
 func (b *Builder) handleSecret(obj *k8sObject) error {
 	fileGroup := &filesObject{
 		k8sObject: obj,
@@ -157,9 +1393,16 @@ func (b *Builder) handleSecret(obj *k8sObject) error {
 	}
 
 	for key, value := range obj.Data {
-		data, err := base64.StdEncoding.DecodeString(value)
+		data, err := decodeBase64(value)
 		if err != nil {
-			return err
+			return fmt.Errorf("secret %s: invalid base64 in data key %q: %w", obj.Metadata.Name, key, err)
+		}
+		if b.opts.decodeSecretsToText && isBinary(data) {
+			if fileGroup.suffixes == nil {
+				fileGroup.suffixes = map[string]string{}
+			}
+			fileGroup.suffixes[key] = ".b64"
+			data = []byte(base64.StdEncoding.EncodeToString(data))
 		}
 		fileGroup.files[key] = data
 	}
@@ -168,30 +1411,158 @@ func (b *Builder) handleSecret(obj *k8sObject) error {
 		fileGroup.files[key] = []byte(value)
 	}
 
+	if obj.Type == "kubernetes.io/tls" {
+		b.handleTLSChain(fileGroup)
+	}
+
 	b.getKustomization(obj).AddSecretObjects(fileGroup)
 	return nil
 }
 
+// decodeBase64 decodes standard base64, ignoring the line breaks and other
+// whitespace some tools pad or wrap it with.
+func decodeBase64(value string) ([]byte, error) {
+	value = strings.Map(func(r rune) rune {
+		if unicode.IsSpace(r) {
+			return -1
+		}
+		return r
+	}, value)
+	return base64.StdEncoding.DecodeString(value)
+}
+
+// handleTLSChain checks that the tls.crt of a TLS secret is PEM encoded and,
+// with WithSplitTLSChain, splits a certificate chain into the leaf in tls.crt
+// and the intermediates in ca.crt.
+func (b *Builder) handleTLSChain(fileGroup *filesObject) {
+	obj := fileGroup.k8sObject
+	crt, ok := fileGroup.files["tls.crt"]
+	if !ok {
+		return
+	}
+	leaf, rest := pem.Decode(crt)
+	if leaf == nil {
+		b.opts.logger.Printf("warning: tls.crt of secret %s is not PEM encoded", obj.Metadata.Name)
+		return
+	}
+	if !b.opts.splitTLSChain {
+		return
+	}
+	if next, _ := pem.Decode(rest); next == nil || next.Type != "CERTIFICATE" {
+		return
+	}
+	if _, ok := fileGroup.files["ca.crt"]; ok {
+		b.opts.logger.Printf("warning: not splitting the tls.crt chain of secret %s as it already has a ca.crt", obj.Metadata.Name)
+		return
+	}
+	fileGroup.files["tls.crt"] = crt[:len(crt)-len(rest)]
+	fileGroup.files["ca.crt"] = rest
+}
+
+// isBinary reports whether data can't be treated as UTF-8 text.
+func isBinary(data []byte) bool {
+	return bytes.IndexByte(data, 0) >= 0 || !utf8.Valid(data)
+}
+
 func (b *Builder) handleGenericResource(obj *k8sObject) error {
+	if b.opts.stripManagedFields && bytes.Contains(obj.Raw, []byte("managedFields")) {
+		raw, err := editYAML(obj.Raw, func(node *yaml.Node) bool {
+			return deleteMappingKey(lookupMappingKey(node, "metadata"), "managedFields")
+		})
+		if err != nil {
+			return err
+		}
+		obj.Raw = raw
+	}
+	if b.opts.canonicalKeyOrder {
+		raw, err := editYAML(obj.Raw, func(node *yaml.Node) bool {
+			return reorderMappingKeys(node, canonicalLeadingKeys, canonicalTrailingKeys)
+		})
+		if err != nil {
+			return err
+		}
+		obj.Raw = raw
+	}
+	if b.opts.generatedAnnotation {
+		annotations := map[string]string{generatedAnnotation: "true"}
+		if b.opts.timestamp {
+			if b.generatedAt == "" {
+				b.generatedAt = time.Now().UTC().Format(time.RFC3339)
+			}
+			annotations[generatedAtAnnotation] = b.generatedAt
+		}
+		raw, err := setAnnotations(obj.Raw, annotations)
+		if err != nil {
+			return err
+		}
+		obj.Raw = raw
+		if obj.Metadata.Annotations == nil {
+			obj.Metadata.Annotations = map[string]string{}
+		}
+		maps.Copy(obj.Metadata.Annotations, annotations)
+	}
 	b.getKustomization(obj).AddK8sObject(obj)
 	return nil
 }
 
+// canonicalLeadingKeys and canonicalTrailingKeys are the top-level keys
+// moved first and last by WithCanonicalKeyOrder, as Kubernetes writes them.
+var (
+	canonicalLeadingKeys  = []string{"apiVersion", "kind", "metadata"}
+	canonicalTrailingKeys = []string{"status"}
+)
+
+const (
+	generatedAnnotation   = "kustomizily.io/generated"
+	generatedAtAnnotation = "kustomizily.io/generated-at"
+)
+
+// setAnnotations sets annotations in the metadata of a resource.
+func setAnnotations(data []byte, annotations map[string]string) ([]byte, error) {
+	return editYAML(data, func(node *yaml.Node) bool {
+		meta := ensureMappingKey(node, "metadata")
+		target := ensureMappingKey(meta, "annotations")
+		for _, key := range slices.Sorted(maps.Keys(annotations)) {
+			setMappingKey(target, key, annotations[key])
+		}
+		return true
+	})
+}
+
+// stripAnnotations removes annotations from the metadata of a resource.
+func stripAnnotations(data []byte, keys ...string) ([]byte, error) {
+	return editYAML(data, func(node *yaml.Node) bool {
+		meta := lookupMappingKey(node, "metadata")
+		changed := false
+		for _, key := range keys {
+			if deleteMappingKey(lookupMappingKey(meta, "annotations"), key) {
+				changed = true
+			}
+		}
+		if a := lookupMappingKey(meta, "annotations"); a != nil && len(a.Content) == 0 {
+			deleteMappingKey(meta, "annotations")
+		}
+		return changed
+	})
+}
+
 type metadata struct {
-	Namespace   string            `yaml:"namespace"`
 	Name        string            `yaml:"name"`
-	Labels      map[string]string `yaml:"labels"`
-	Annotations map[string]string `yaml:"annotations"`
+	Namespace   string            `yaml:"namespace,omitempty"`
+	Labels      map[string]string `yaml:"labels,omitempty"`
+	Annotations map[string]string `yaml:"annotations,omitempty"`
 }
 
 type specNames struct {
 	Plural string `yaml:"plural"`
+	Kind   string `yaml:"kind"`
 }
 
 type spec struct {
 	// For CustomResourceDefinition
 	Group string    `yaml:"group"`
 	Names specNames `yaml:"names"`
+	Scope string    `yaml:"scope"`
 }
 
 type k8sObject struct {
@@ -207,5 +1578,16 @@ type k8sObject struct {
 	Immutable  bool              `yaml:"immutable"`
 	Type       string            `yaml:"type"`
 
+	// ServiceAccount fields
+	ImagePullSecrets []struct {
+		Name string `yaml:"name"`
+	} `yaml:"imagePullSecrets"`
+
+	// Kustomization fields
+	Resources  []string    `yaml:"resources"`
+	HelmCharts []yaml.Node `yaml:"helmCharts"`
+
 	Raw []byte
+	// Filename overrides the filename selected for the resource.
+	Filename string `yaml:"-"`
 }
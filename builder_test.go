@@ -0,0 +1,1512 @@
+package kustomizily
+
+import (
+	"maps"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// build processes input with a Builder using opts and returns the output
+// files by path.
+func build(t *testing.T, input string, opts ...Option) map[string]string {
+	t.Helper()
+	b := NewBuilder(opts...)
+	if err := b.Process(strings.NewReader(input)); err != nil {
+		t.Fatal(err)
+	}
+	return buildFiles(t, b)
+}
+
+// buildFiles builds b into a MemFS and returns the output files by path.
+func buildFiles(t *testing.T, b *Builder) map[string]string {
+	t.Helper()
+	fs := NewMemFS()
+	if err := b.Build(fs.WriteFile); err != nil {
+		t.Fatal(err)
+	}
+	files := map[string]string{}
+	for _, file := range fs.Files() {
+		files[file.Path] = string(file.Data)
+	}
+	return files
+}
+
+// checkContains reports an error for each of want missing from the file
+// name of files.
+func checkContains(t *testing.T, files map[string]string, name string, want ...string) {
+	t.Helper()
+	data, ok := files[name]
+	if !ok {
+		t.Errorf("%s not written", name)
+		return
+	}
+	for _, want := range want {
+		if !strings.Contains(data, want) {
+			t.Errorf("%s = %q, want it to contain %q", name, data, want)
+		}
+	}
+}
+
+// writeTree writes files, keyed by slash-separated path, under a new
+// temporary directory and returns it.
+func writeTree(t *testing.T, files map[string]string) string {
+	t.Helper()
+	root := t.TempDir()
+	for name, data := range files {
+		name = filepath.Join(root, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(name, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return root
+}
+
+const testService = `apiVersion: v1
+kind: Service
+metadata:
+  name: web
+`
+
+func TestDropEmptyDirsAfterChildren(t *testing.T) {
+	root := writeTree(t, map[string]string{
+		"a/sub/x.yaml": testService,
+		"b/x.yaml":     testService,
+	})
+	b := NewBuilder(WithPreserveInputDirs(true), WithAllowDuplicates(true))
+	if err := b.ProcessDir(root); err != nil {
+		t.Fatal(err)
+	}
+	files := buildFiles(t, b)
+
+	for _, name := range []string{"a/kustomization.yaml", "a/sub/kustomization.yaml"} {
+		if _, ok := files[name]; ok {
+			t.Errorf("unexpected %s", name)
+		}
+	}
+	if root := files["kustomization.yaml"]; strings.Contains(root, "- a\n") || !strings.Contains(root, "- b\n") {
+		t.Errorf("unexpected root kustomization:\n%s", root)
+	}
+}
+
+func TestKeepEmptyDirs(t *testing.T) {
+	root := writeTree(t, map[string]string{
+		"a/sub/x.yaml": testService,
+		"b/x.yaml":     testService,
+	})
+	b := NewBuilder(WithPreserveInputDirs(true), WithAllowDuplicates(true), WithKeepEmptyDirs(true))
+	if err := b.ProcessDir(root); err != nil {
+		t.Fatal(err)
+	}
+	files := buildFiles(t, b)
+
+	if _, ok := files["a/sub/kustomization.yaml"]; !ok {
+		t.Errorf("missing a/sub/kustomization.yaml, got %v", slices.Sorted(maps.Keys(files)))
+	}
+}
+
+const testAnnotatedConfigMaps = `apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: a
+  annotations:
+    team: x
+    prometheus.io/scrape: "true"
+data:
+  key: a
+---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: b
+  annotations:
+    team: x
+    prometheus.io/scrape: "true"
+data:
+  key: b
+`
+
+func TestNoHoistAnnotations(t *testing.T) {
+	tests := []struct {
+		name string
+		opts []Option
+		want string
+	}{
+		{
+			name: "default",
+			want: `generatorOptions:
+  disableNameSuffixHash: true
+  annotations:
+    "team": "x"
+
+configMapGenerator:
+- name: a
+  options:
+    annotations:
+      "prometheus.io/scrape": "true"
+`,
+		},
+		{
+			name: "custom",
+			opts: []Option{WithNoHoistAnnotations([]string{"team"})},
+			want: `generatorOptions:
+  disableNameSuffixHash: true
+  annotations:
+    "prometheus.io/scrape": "true"
+
+configMapGenerator:
+- name: a
+  options:
+    annotations:
+      "team": "x"
+`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			files := build(t, testAnnotatedConfigMaps, tt.opts...)
+			if got := files["kustomization.yaml"]; !strings.Contains(got, tt.want) {
+				t.Errorf("got:\n%s\nwant it to contain:\n%s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestProcessBOM(t *testing.T) {
+	bom := "\xEF\xBB\xBF"
+	t.Run("yaml", func(t *testing.T) {
+		files := build(t, bom+testService)
+		if _, ok := files["service.yaml"]; !ok {
+			t.Errorf("missing service.yaml, got %v", slices.Sorted(maps.Keys(files)))
+		}
+	})
+	t.Run("json", func(t *testing.T) {
+		b := NewBuilder()
+		if err := b.ProcessJSON(strings.NewReader(bom + `{"apiVersion":"v1","kind":"Service","metadata":{"name":"web"}}`)); err != nil {
+			t.Fatal(err)
+		}
+		files := buildFiles(t, b)
+		if _, ok := files["service.yaml"]; !ok {
+			t.Errorf("missing service.yaml, got %v", slices.Sorted(maps.Keys(files)))
+		}
+	})
+	t.Run("json file", func(t *testing.T) {
+		root := writeTree(t, map[string]string{
+			"web.json": bom + `{"apiVersion":"v1","kind":"Service","metadata":{"name":"web"}}`,
+		})
+		b := NewBuilder()
+		if err := b.ProcessDir(root); err != nil {
+			t.Fatal(err)
+		}
+		files := buildFiles(t, b)
+		if _, ok := files["service.yaml"]; !ok {
+			t.Errorf("missing service.yaml, got %v", slices.Sorted(maps.Keys(files)))
+		}
+	})
+}
+
+func TestPreserveInputDirs(t *testing.T) {
+	root := writeTree(t, map[string]string{
+		"a/x.yaml": testService,
+		"b/y.yaml": strings.Replace(testService, "name: web", "name: api", 1),
+	})
+	b := NewBuilder(WithPreserveInputDirs(true))
+	if err := b.ProcessDir(root); err != nil {
+		t.Fatal(err)
+	}
+	files := buildFiles(t, b)
+
+	for _, name := range []string{"a/service.yaml", "a/kustomization.yaml", "b/service.yaml", "b/kustomization.yaml"} {
+		if _, ok := files[name]; !ok {
+			t.Errorf("missing %s, got %v", name, slices.Sorted(maps.Keys(files)))
+		}
+	}
+	if got, want := files["kustomization.yaml"], "resources:\n- a\n- b\n"; !strings.Contains(got, want) {
+		t.Errorf("got root kustomization:\n%s\nwant it to contain:\n%s", got, want)
+	}
+}
+
+func TestProcessDirResolveReferences(t *testing.T) {
+	root := writeTree(t, map[string]string{
+		"deployment.yaml": `apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: myapp-web
+`,
+		"kustomization.yaml": `apiVersion: kustomize.config.k8s.io/v1beta1
+kind: Kustomization
+resources:
+- deployment.yaml
+`,
+	})
+	b := NewBuilder(WithResolveReferences(true))
+	if err := b.ProcessDir(root); err != nil {
+		t.Fatal(err)
+	}
+	files := buildFiles(t, b)
+	if _, ok := files["deployment.yaml"]; !ok {
+		t.Errorf("missing deployment.yaml, got %v", slices.Sorted(maps.Keys(files)))
+	}
+}
+
+const testLabeledWorkload = `apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: web
+  labels:
+    app: web
+spec:
+  selector:
+    matchLabels:
+      app: web
+---
+apiVersion: v1
+kind: Service
+metadata:
+  name: web
+  labels:
+    app: web
+spec:
+  selector:
+    app: web
+`
+
+func TestHoistCommonLabels(t *testing.T) {
+	tests := []struct {
+		name        string
+		opts        []Option
+		keepsLabels bool
+		notHoisted  bool
+	}{
+		{name: "add only", keepsLabels: true},
+		{name: "add and strip", opts: []Option{WithLabelHoistStrip(true)}},
+		{name: "disabled", opts: []Option{WithHoistCommonLabels(false), WithLabelHoistStrip(true)}, keepsLabels: true, notHoisted: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			files := build(t, testLabeledWorkload, tt.opts...)
+			got, want := files["web/kustomization.yaml"], "labels:\n- pairs:\n    \"app\": \"web\"\n"
+			if tt.notHoisted && strings.Contains(got, "labels:") {
+				t.Errorf("got kustomization:\n%s\nwant no labels", got)
+			} else if !tt.notHoisted && !strings.Contains(got, want) {
+				t.Errorf("got kustomization:\n%s\nwant it to contain:\n%s", got, want)
+			}
+			for _, name := range []string{"web/deployment.yaml", "web/service.yaml"} {
+				got := files[name]
+				if strings.Contains(got, "metadata:\n  name: web\n  labels:\n    app: web\n") != tt.keepsLabels {
+					t.Errorf("%s: unexpected metadata labels:\n%s", name, got)
+				}
+			}
+			if got := files["web/deployment.yaml"]; !strings.Contains(got, "matchLabels:\n      app: web") {
+				t.Errorf("selector was changed:\n%s", got)
+			}
+			if got := files["web/service.yaml"]; !strings.Contains(got, "selector:\n    app: web") {
+				t.Errorf("selector was changed:\n%s", got)
+			}
+		})
+	}
+}
+
+func TestProcessDetectsJSON(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+	}{
+		{
+			name: "stream",
+			input: `{"apiVersion":"v1","kind":"Service","metadata":{"name":"a"}}
+{"apiVersion":"v1","kind":"Service","metadata":{"name":"b"}}
+`,
+		},
+		{
+			name: "array",
+			input: `  [
+  {"apiVersion":"v1","kind":"Service","metadata":{"name":"a"}},
+  {"apiVersion":"v1","kind":"Service","metadata":{"name":"b"}}
+]`,
+		},
+		{
+			name: "JSON and YAML documents",
+			input: `{"apiVersion":"v1","kind":"Service","metadata":{"name":"a"}}
+---
+apiVersion: v1
+kind: Service
+metadata:
+  name: b
+`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			files := build(t, tt.input)
+			for _, name := range []string{"a.yaml", "b.yaml"} {
+				if _, ok := files[name]; !ok {
+					t.Errorf("missing %s, got %v", name, slices.Sorted(maps.Keys(files)))
+				}
+			}
+		})
+	}
+}
+
+const testPrefixedServiceAccounts = `apiVersion: v1
+kind: ServiceAccount
+metadata:
+  name: myapp-web
+---
+apiVersion: v1
+kind: ServiceAccount
+metadata:
+  name: myapp-api
+`
+
+func TestHoistNamePrefix(t *testing.T) {
+	files := build(t, testPrefixedServiceAccounts, WithHoistNamePrefix(true))
+	if got := files["kustomization.yaml"]; !strings.Contains(got, "namePrefix: myapp-\n") {
+		t.Errorf("kustomization.yaml = %q, want namePrefix myapp-", got)
+	}
+
+	files = build(t, testPrefixedServiceAccounts, WithHoistNamePrefix(true), WithImagePullSecret("regcred"))
+	got := files["kustomization.yaml"]
+	if strings.Contains(got, "namePrefix:") {
+		t.Errorf("kustomization.yaml = %q, want no namePrefix with generated patches", got)
+	}
+	if !strings.Contains(got, "name: myapp-web") {
+		t.Errorf("kustomization.yaml = %q, want the patch to target myapp-web", got)
+	}
+	for name, data := range files {
+		if name != "kustomization.yaml" && !strings.Contains(data, "name: myapp-") {
+			t.Errorf("%s = %q, want the name kept whole", name, data)
+		}
+	}
+}
+
+const testSameNameWorkload = `apiVersion: v1
+kind: Service
+metadata:
+  name: web
+---
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: web
+`
+
+func TestFlatLayoutSameName(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		input string
+		want  []string
+	}{
+		{
+			name:  "single name",
+			input: testSameNameWorkload,
+			want:  []string{"deployment.yaml", "service.yaml"},
+		},
+		{
+			name:  "several names",
+			input: testSameNameWorkload + "---\napiVersion: v1\nkind: Service\nmetadata:\n  name: api\n",
+			want:  []string{"api_service.yaml", "web_deployment.yaml", "web_service.yaml"},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			files := build(t, tc.input, WithFlatLayout(true))
+			got := slices.Sorted(maps.Keys(files))
+			want := append([]string{"kustomization.yaml"}, tc.want...)
+			slices.Sort(want)
+			if !slices.Equal(got, want) {
+				t.Fatalf("files = %v, want %v", got, want)
+			}
+			for _, name := range tc.want {
+				if !strings.Contains(files["kustomization.yaml"], "- "+name+"\n") {
+					t.Errorf("kustomization.yaml = %q, want it to reference %s", files["kustomization.yaml"], name)
+				}
+			}
+		})
+	}
+}
+
+const testMixedSecret = `apiVersion: v1
+kind: Secret
+metadata:
+  name: creds
+data:
+  bin: AAEKAgo=
+  text: aGVsbG8Kd29ybGQK
+`
+
+func TestSecretDataLineEnding(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		opts []Option
+		text string
+	}{
+		{
+			name: "lf",
+			text: "hello\nworld\n",
+		},
+		{
+			name: "crlf",
+			opts: []Option{WithLineEnding("crlf")},
+			text: "hello\r\nworld\r\n",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			files := build(t, testMixedSecret, tc.opts...)
+			if got, want := files["bin"], "\x00\x01\n\x02\n"; got != want {
+				t.Errorf("bin = %q, want %q", got, want)
+			}
+			if got := files["text"]; got != tc.text {
+				t.Errorf("text = %q, want %q", got, tc.text)
+			}
+		})
+	}
+}
+
+func TestIsBinary(t *testing.T) {
+	for _, tc := range []struct {
+		data string
+		want bool
+	}{
+		{"", false},
+		{"hello\nworld\n", false},
+		{"héllo", false},
+		{"\x00\x01\n\x02\n", true},
+		{"\xff\xfe", true},
+	} {
+		if got := isBinary([]byte(tc.data)); got != tc.want {
+			t.Errorf("isBinary(%q) = %v, want %v", tc.data, got, tc.want)
+		}
+	}
+}
+
+const testDockerConfigSecret = `apiVersion: v1
+kind: Secret
+metadata:
+  name: regcred
+type: kubernetes.io/dockerconfigjson
+data:
+  .dockerconfigjson: e30=
+`
+
+func TestDotPrefixedSecretKeys(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		input string
+		files map[string]string
+		want  []string
+	}{
+		{
+			name:  "dockerconfigjson",
+			input: testDockerConfigSecret,
+			files: map[string]string{"dockerconfigjson": "{}"},
+			want: []string{
+				"  type: kubernetes.io/dockerconfigjson\n",
+				"  - .dockerconfigjson=dockerconfigjson\n",
+			},
+		},
+		{
+			name:  "name prefixed",
+			input: testDockerConfigSecret + "---\n" + strings.ReplaceAll(testDockerConfigSecret, "regcred", "mirror"),
+			files: map[string]string{"regcred_dockerconfigjson": "{}", "mirror_dockerconfigjson": "{}"},
+			want: []string{
+				"  - .dockerconfigjson=regcred_dockerconfigjson\n",
+				"  - .dockerconfigjson=mirror_dockerconfigjson\n",
+			},
+		},
+		{
+			name:  "hidden",
+			input: "apiVersion: v1\nkind: Secret\nmetadata:\n  name: other\ndata:\n  .hidden: aGk=\n",
+			files: map[string]string{".hidden": "hi"},
+			want:  []string{"  - .hidden\n"},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			files := build(t, tc.input)
+			for name, want := range tc.files {
+				if got := files[name]; got != want {
+					t.Errorf("%s = %q, want %q", name, got, want)
+				}
+			}
+			kustomization := files["kustomization.yaml"]
+			for _, want := range tc.want {
+				if !strings.Contains(kustomization, want) {
+					t.Errorf("kustomization.yaml = %q, want it to contain %q", kustomization, want)
+				}
+			}
+		})
+	}
+}
+
+const testNamespacedRoles = `apiVersion: rbac.authorization.k8s.io/v1
+kind: Role
+metadata:
+  name: reader
+  namespace: a
+rules:
+- verbs: ["get"]
+---
+apiVersion: rbac.authorization.k8s.io/v1
+kind: Role
+metadata:
+  name: pod-reader
+  namespace: b
+rules:
+- verbs: ["get"]
+---
+apiVersion: v1
+kind: Service
+metadata:
+  name: web
+  namespace: a
+`
+
+func TestContentDedup(t *testing.T) {
+	files := build(t, testNamespacedRoles, WithLayoutStrategy(LayoutByNamespace), WithContentDedup("shared"))
+
+	if got := files["shared/reader_role/role.yaml"]; strings.Contains(got, "namespace:") || !strings.Contains(got, "name: reader") {
+		t.Errorf("shared/reader_role/role.yaml = %q, want the role without namespace", got)
+	}
+	if got := files["kustomization.yaml"]; strings.Contains(got, "shared") {
+		t.Errorf("kustomization.yaml = %q, want shared not referenced", got)
+	}
+	if _, ok := files["a/role.yaml"]; ok {
+		t.Errorf("a/role.yaml written, want it shared")
+	}
+	for _, tc := range []struct {
+		dir  string
+		want []string
+		not  []string
+	}{
+		{
+			dir:  "a",
+			want: []string{"- ../shared/reader_role\n", "- service.yaml\n", "path: /metadata/namespace\n      value: a\n"},
+			not:  []string{"/metadata/name\n", "allowNameChange"},
+		},
+		{
+			dir:  "b",
+			want: []string{"- ../shared/reader_role\n", "path: /metadata/name\n      value: pod-reader\n", "path: /metadata/namespace\n      value: b\n", "allowNameChange: true\n"},
+		},
+	} {
+		got := files[tc.dir+"/kustomization.yaml"]
+		for _, want := range tc.want {
+			if !strings.Contains(got, want) {
+				t.Errorf("%s/kustomization.yaml = %q, want it to contain %q", tc.dir, got, want)
+			}
+		}
+		for _, not := range tc.not {
+			if strings.Contains(got, not) {
+				t.Errorf("%s/kustomization.yaml = %q, want it not to contain %q", tc.dir, got, not)
+			}
+		}
+	}
+}
+
+func TestContentDedupDuplicates(t *testing.T) {
+	b := NewBuilder(WithContentDedup("shared"))
+	err := b.Process(strings.NewReader(testService + "\n---\n" + testService))
+	if err == nil || !strings.Contains(err.Error(), "duplicate") {
+		t.Errorf("Process = %v, want a duplicate resource error", err)
+	}
+}
+
+func TestProcessMixedYAMLAndJSON(t *testing.T) {
+	files := build(t, `apiVersion: v1
+kind: Service
+metadata:
+  name: a
+---
+{"apiVersion":"v1","kind":"Service","metadata":{"name":"b"}}
+`)
+	for _, name := range []string{"a", "b"} {
+		want := "apiVersion: v1\nkind: Service\nmetadata:\n  name: " + name
+		if got := files[name+".yaml"]; got != want {
+			t.Errorf("%s.yaml = %q, want %q", name, got, want)
+		}
+	}
+}
+
+func TestResolveReferences(t *testing.T) {
+	root := writeTree(t, map[string]string{
+		"service.yaml": testService,
+		"kustomization.yaml": `apiVersion: kustomize.config.k8s.io/v1beta1
+kind: Kustomization
+resources:
+- service.yaml
+`,
+	})
+	for _, tc := range []struct {
+		resolve bool
+		want    bool
+	}{
+		{resolve: false, want: false},
+		{resolve: true, want: true},
+	} {
+		b := NewBuilder(WithResolveReferences(tc.resolve))
+		if err := b.ProcessFile(filepath.Join(root, "kustomization.yaml")); err != nil {
+			t.Fatal(err)
+		}
+		files := buildFiles(t, b)
+		if got := files["service.yaml"]; (got == strings.TrimSuffix(testService, "\n")) != tc.want {
+			t.Errorf("resolve %v: service.yaml = %q", tc.resolve, got)
+		}
+	}
+}
+
+func TestRootResourcesOrder(t *testing.T) {
+	docs := []string{
+		"apiVersion: v1\nkind: Service\nmetadata:\n  name: web\n  labels:\n    app: web\n",
+		"apiVersion: v1\nkind: Service\nmetadata:\n  name: api\n  labels:\n    app: api\n",
+		"apiVersion: v1\nkind: Service\nmetadata:\n  name: db\n  labels:\n    app: db\n",
+	}
+	for _, order := range [][]int{{0, 1, 2}, {2, 1, 0}, {1, 2, 0}} {
+		var input []string
+		for _, i := range order {
+			input = append(input, docs[i])
+		}
+		files := build(t, strings.Join(input, "---\n"))
+		checkContains(t, files, "kustomization.yaml", "resources:\n- api\n- db\n- web\n")
+	}
+}
+
+const testWebAndAPI = `apiVersion: v1
+kind: Service
+metadata:
+  name: web
+  labels:
+    app: web
+---
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: web
+  labels:
+    app: web
+---
+apiVersion: v1
+kind: ServiceAccount
+metadata:
+  name: web
+  labels:
+    app: web
+---
+apiVersion: v1
+kind: Service
+metadata:
+  name: api
+  labels:
+    app: api
+`
+
+func TestAutoLayout(t *testing.T) {
+	files := build(t, testWebAndAPI, WithAutoLayout(2))
+	got := slices.Sorted(maps.Keys(files))
+	want := []string{
+		"api/kustomization.yaml",
+		"api/service.yaml",
+		"kustomization.yaml",
+		"web/deployment/deployment.yaml",
+		"web/deployment/kustomization.yaml",
+		"web/kustomization.yaml",
+		"web/service/kustomization.yaml",
+		"web/service/service.yaml",
+		"web/serviceaccount/kustomization.yaml",
+		"web/serviceaccount/serviceaccount.yaml",
+	}
+	if !slices.Equal(got, want) {
+		t.Errorf("files = %v, want %v", got, want)
+	}
+	checkContains(t, files, "web/kustomization.yaml", "resources:\n- deployment\n- service\n- serviceaccount\n")
+}
+
+func TestComponentDir(t *testing.T) {
+	files := build(t, `apiVersion: v1
+kind: Service
+metadata:
+  name: web
+  labels:
+    app: web
+  annotations:
+    kustomizily.io/kind: Component
+---
+apiVersion: v1
+kind: Service
+metadata:
+  name: api
+  labels:
+    app: api
+`)
+	checkContains(t, files, "kustomization.yaml", "resources:\n- api\n", "components:\n- web\n")
+	checkContains(t, files, "web/kustomization.yaml", "apiVersion: kustomize.config.k8s.io/v1alpha1\nkind: Component\n")
+	checkContains(t, files, "api/kustomization.yaml", "apiVersion: kustomize.config.k8s.io/v1beta1\nkind: Kustomization\n")
+	if got, want := files["web/service.yaml"], "apiVersion: v1\nkind: Service\nmetadata:\n  name: web\n  labels:\n    app: web"; got != want {
+		t.Errorf("web/service.yaml = %q, want %q without the annotation", got, want)
+	}
+}
+
+const testDuplicatedDeployment = `apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: web
+  labels:
+    app: a
+---
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: web
+  labels:
+    app: b
+`
+
+func TestDuplicatePolicy(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		opts []Option
+		want []string
+	}{
+		{name: "keep all", opts: []Option{WithDuplicatePolicy(DuplicateKeepAll)}, want: []string{"a/deployment.yaml", "b/deployment.yaml"}},
+		{name: "keep first", opts: []Option{WithDuplicatePolicy(DuplicateKeepFirst)}, want: []string{"a/deployment.yaml"}},
+		{name: "keep last", opts: []Option{WithDuplicatePolicy(DuplicateKeepLast)}, want: []string{"b/deployment.yaml"}},
+		{name: "allow duplicates", opts: []Option{WithAllowDuplicates(true)}, want: []string{"b/deployment.yaml"}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			files := build(t, testDuplicatedDeployment, tc.opts...)
+			var got []string
+			for name := range files {
+				if path.Base(name) == "deployment.yaml" {
+					got = append(got, name)
+				}
+			}
+			slices.Sort(got)
+			if !slices.Equal(got, tc.want) {
+				t.Errorf("deployments = %v, want %v", got, tc.want)
+			}
+		})
+	}
+
+	for _, opts := range [][]Option{nil, {WithDuplicatePolicy(DuplicateError)}, {WithAllowDuplicates(false)}} {
+		b := NewBuilder(opts...)
+		err := b.Process(strings.NewReader(testDuplicatedDeployment))
+		if err == nil || !strings.Contains(err.Error(), "duplicate resource") || !strings.Contains(err.Error(), "Deployment") {
+			t.Errorf("Process = %v, want a duplicate resource error", err)
+		}
+	}
+}
+
+const testManagedService = `apiVersion: v1
+kind: Service
+metadata:
+  name: web
+  managedFields:
+  - manager: kubectl
+    operation: Apply
+spec:
+  type: ClusterIP
+`
+
+func TestStripManagedFields(t *testing.T) {
+	files := build(t, testManagedService)
+	if got, want := files["service.yaml"], "apiVersion: v1\nkind: Service\nmetadata:\n  name: web\nspec:\n  type: ClusterIP"; got != want {
+		t.Errorf("service.yaml = %q, want %q", got, want)
+	}
+
+	files = build(t, testManagedService, WithStripManagedFields(false))
+	checkContains(t, files, "service.yaml", "managedFields:")
+}
+
+func TestConfigDir(t *testing.T) {
+	files := build(t, testConfigMapAndSecret+"---\n"+testService, WithConfigDir("config"))
+	got := slices.Sorted(maps.Keys(files))
+	want := []string{"config/app.conf", "config/kustomization.yaml", "config/token", "kustomization.yaml", "service.yaml"}
+	if !slices.Equal(got, want) {
+		t.Errorf("files = %v, want %v", got, want)
+	}
+	checkContains(t, files, "kustomization.yaml", "resources:\n- config\n- service.yaml\n")
+	checkContains(t, files, "config/kustomization.yaml", "configMapGenerator:\n- name: app\n", "secretGenerator:\n- name: creds\n")
+}
+
+const testCustomResources = `apiVersion: apiextensions.k8s.io/v1
+kind: CustomResourceDefinition
+metadata:
+  name: widgets.example.com
+spec:
+  group: example.com
+  scope: Namespaced
+  names:
+    kind: Widget
+    plural: widgets
+---
+apiVersion: apiextensions.k8s.io/v1
+kind: CustomResourceDefinition
+metadata:
+  name: gadgets.example.com
+spec:
+  group: example.com
+  scope: Cluster
+  names:
+    kind: Gadget
+    plural: gadgets
+---
+apiVersion: example.com/v1
+kind: Widget
+metadata:
+  name: w
+  namespace: default
+  labels:
+    app: web
+---
+apiVersion: example.com/v1
+kind: Gadget
+metadata:
+  name: g
+  labels:
+    app: web
+`
+
+func TestClusterScopedDir(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		opts []Option
+		want []string
+	}{
+		{
+			name: "default",
+			want: []string{"web/gadget.yaml", "web/widget.yaml"},
+		},
+		{
+			name: "cluster dir",
+			opts: []Option{WithClusterScopedDir("cluster")},
+			want: []string{"cluster/gadget.yaml", "web/widget.yaml"},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			files := build(t, testCustomResources, tc.opts...)
+			for _, name := range tc.want {
+				if _, ok := files[name]; !ok {
+					t.Errorf("missing %s, got %v", name, slices.Sorted(maps.Keys(files)))
+				}
+			}
+			for _, name := range []string{"crd/example.com_gadgets.yaml", "crd/example.com_widgets.yaml"} {
+				if _, ok := files[name]; !ok {
+					t.Errorf("missing %s", name)
+				}
+			}
+		})
+	}
+}
+
+func TestLenientFieldNames(t *testing.T) {
+	const input = "apiversion: v1\nKind: Service\nmetadata:\n  name: web\n"
+	files := build(t, input)
+	if _, ok := files["service.yaml"]; ok {
+		t.Error("service.yaml written, want the document skipped by default")
+	}
+
+	files = build(t, input, WithLenientFieldNames(true))
+	if got, want := files["service.yaml"], "apiVersion: v1\nkind: Service\nmetadata:\n  name: web"; got != want {
+		t.Errorf("service.yaml = %q, want %q", got, want)
+	}
+}
+
+func TestGitAttributes(t *testing.T) {
+	files := build(t, testStringDataSecret, WithGitAttributes(true))
+	if got, want := files[".gitattributes"], "/bin binary\n"; got != want {
+		t.Errorf(".gitattributes = %q, want %q", got, want)
+	}
+
+	files = build(t, testStringDataSecret)
+	if _, ok := files[".gitattributes"]; ok {
+		t.Error(".gitattributes written by default")
+	}
+}
+
+func TestCollapseSingletonDirs(t *testing.T) {
+	files := build(t, testWebAndAPI, WithCollapseSingletonDirs(true))
+	got := slices.Sorted(maps.Keys(files))
+	want := []string{
+		"api_service.yaml",
+		"kustomization.yaml",
+		"web/deployment.yaml",
+		"web/kustomization.yaml",
+		"web/service.yaml",
+		"web/serviceaccount.yaml",
+	}
+	if !slices.Equal(got, want) {
+		t.Errorf("files = %v, want %v", got, want)
+	}
+	checkContains(t, files, "kustomization.yaml", "resources:\n- web\n- api_service.yaml\n")
+}
+
+func TestNamespacedOverlay(t *testing.T) {
+	files := build(t, testWebAndAPI, WithNamespacedOverlay("prod", "prod-"))
+	want := "apiVersion: kustomize.config.k8s.io/v1beta1\nkind: Kustomization\n\nnamespace: prod\nnamePrefix: prod-\n\nresources:\n- ../base\n"
+	if got := files["overlay/kustomization.yaml"]; got != want {
+		t.Errorf("overlay/kustomization.yaml = %q, want %q", got, want)
+	}
+	checkContains(t, files, "base/kustomization.yaml", "resources:\n- api\n- web\n")
+	checkContains(t, files, "base/web/deployment.yaml", "name: web\n")
+	if _, ok := files["kustomization.yaml"]; ok {
+		t.Error("kustomization.yaml written at the root, want the base under base")
+	}
+}
+
+const testTaggedDeployment = `apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: web
+spec:
+  template:
+    spec:
+      containers:
+      - name: web
+        image: nginx:${TAG}
+`
+
+func TestEnvSubst(t *testing.T) {
+	files := build(t, testTaggedDeployment, WithEnvSubstMap(map[string]string{"TAG": "1.27"}))
+	checkContains(t, files, "deployment.yaml", "image: nginx:1.27")
+
+	t.Setenv("TAG", "1.26")
+	files = build(t, testTaggedDeployment, WithEnvSubst(true))
+	checkContains(t, files, "deployment.yaml", "image: nginx:1.26")
+
+	files = build(t, testTaggedDeployment)
+	checkContains(t, files, "deployment.yaml", "image: nginx:${TAG}")
+
+	files = build(t, testTaggedDeployment, WithEnvSubstMap(map[string]string{}))
+	checkContains(t, files, "deployment.yaml", "image: nginx:${TAG}")
+
+	b := NewBuilder(WithEnvSubstMap(map[string]string{}), WithEnvSubstStrict(true))
+	if err := b.Process(strings.NewReader(testTaggedDeployment)); err == nil || !strings.Contains(err.Error(), "TAG") {
+		t.Errorf("Process = %v, want an undefined variable error", err)
+	}
+}
+
+const testChartResources = `apiVersion: v1
+kind: Service
+metadata:
+  name: nginx
+  labels:
+    helm.sh/chart: nginx-1.2.3
+    app: frontend
+---
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: nginx
+  labels:
+    helm.sh/chart: nginx-1.2.3
+---
+apiVersion: v1
+kind: Service
+metadata:
+  name: redis-master
+  labels:
+    helm.sh/chart: redis-17.0.0
+---
+apiVersion: v1
+kind: Service
+metadata:
+  name: web
+  labels:
+    app: web
+`
+
+func TestGroupByChart(t *testing.T) {
+	files := build(t, testChartResources, WithGroupByChart(true))
+	for _, name := range []string{"nginx/service.yaml", "nginx/deployment.yaml", "redis/service.yaml", "web/service.yaml"} {
+		if _, ok := files[name]; !ok {
+			t.Errorf("%s not written", name)
+		}
+	}
+	checkContains(t, files, "kustomization.yaml", "- nginx\n", "- redis\n", "- web\n")
+
+	files = build(t, testChartResources)
+	if _, ok := files["frontend/service.yaml"]; !ok {
+		t.Error("frontend/service.yaml not written, want the app label to group without the option")
+	}
+}
+
+const testNetworkingResources = `apiVersion: networking.k8s.io/v1
+kind: Ingress
+metadata:
+  name: web
+  labels:
+    app: web
+---
+apiVersion: gateway.networking.k8s.io/v1
+kind: Gateway
+metadata:
+  name: public
+---
+apiVersion: v1
+kind: Service
+metadata:
+  name: web
+  labels:
+    app: web
+---
+apiVersion: example.com/v1
+kind: Route
+metadata:
+  name: extra
+`
+
+func TestGroupNetworking(t *testing.T) {
+	files := build(t, testNetworkingResources, WithGroupNetworking(true), WithNetworkingKinds([]string{"Route"}))
+	for _, name := range []string{"networking/ingress.yaml", "networking/gateway.yaml", "networking/route.yaml", "web/service.yaml"} {
+		if _, ok := files[name]; !ok {
+			t.Errorf("%s not written", name)
+		}
+	}
+
+	files = build(t, testNetworkingResources)
+	if _, ok := files["web/ingress.yaml"]; !ok {
+		t.Error("web/ingress.yaml not written, want the app label to group without the option")
+	}
+}
+
+const testSealedSecret = `apiVersion: bitnami.com/v1alpha1
+kind: SealedSecret
+metadata:
+  name: db-creds
+  labels:
+    app: web
+spec:
+  encryptedData:
+    password: AgBy3i4OJSWK
+---
+apiVersion: v1
+kind: Service
+metadata:
+  name: web
+  labels:
+    app: web
+`
+
+func TestTreatAsGenerator(t *testing.T) {
+	files := build(t, testSealedSecret, WithConfigDir("config"), WithTreatAsGenerator([]string{"SealedSecret"}))
+	checkContains(t, files, "config/db-creds.yaml", "kind: SealedSecret\n")
+	checkContains(t, files, "config/kustomization.yaml", "resources:\n- db-creds.yaml\n")
+	if _, ok := files["web/service.yaml"]; !ok {
+		t.Error("web/service.yaml not written")
+	}
+
+	files = build(t, testSealedSecret, WithConfigDir("config"))
+	if _, ok := files["web/sealedsecret.yaml"]; !ok {
+		t.Error("web/sealedsecret.yaml not written, want the SealedSecret routed by its labels without the option")
+	}
+}
+
+const testLists = `apiVersion: v1
+kind: List
+items:
+- apiVersion: v1
+  kind: Service
+  metadata:
+    name: web
+    labels:
+      app: web
+- apiVersion: v1
+  kind: Service
+  metadata:
+    name: api
+    labels:
+      app: api
+---
+apiVersion: v1
+kind: ConfigMapList
+items:
+- apiVersion: v1
+  kind: ConfigMap
+  metadata:
+    name: app
+    labels:
+      app: web
+  data:
+    a: "1"
+`
+
+func TestProcessLists(t *testing.T) {
+	files := build(t, testLists)
+	got := slices.Sorted(maps.Keys(files))
+	want := []string{"api/kustomization.yaml", "api/service.yaml", "kustomization.yaml", "web/kustomization.yaml", "web/service.yaml"}
+	if !slices.Equal(got, want) {
+		t.Errorf("files = %v, want %v", got, want)
+	}
+	checkContains(t, files, "web/service.yaml", "kind: Service\nmetadata:\n  name: web\n")
+	checkContains(t, files, "api/service.yaml", "kind: Service\nmetadata:\n  name: api\n")
+	checkContains(t, files, "web/kustomization.yaml", "configMapGenerator:\n- name: app\n")
+}
+
+const testEnvironments = `apiVersion: v1
+kind: Service
+metadata:
+  name: web
+  labels:
+    environment: dev
+---
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: web
+  labels:
+    environment: dev
+spec:
+  replicas: 1
+---
+apiVersion: v1
+kind: Service
+metadata:
+  name: web
+  labels:
+    environment: prod
+---
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: web
+  labels:
+    environment: prod
+spec:
+  replicas: 3
+---
+apiVersion: v1
+kind: ServiceAccount
+metadata:
+  name: web
+`
+
+func TestSharedBase(t *testing.T) {
+	files := build(t, testEnvironments, WithSharedBase("base"))
+	got := slices.Sorted(maps.Keys(files))
+	want := []string{
+		"base/kustomization.yaml",
+		"base/service.yaml",
+		"base/serviceaccount.yaml",
+		"overlays/dev/deployment.yaml",
+		"overlays/dev/kustomization.yaml",
+		"overlays/prod/deployment.yaml",
+		"overlays/prod/kustomization.yaml",
+	}
+	if !slices.Equal(got, want) {
+		t.Errorf("files = %v, want %v", got, want)
+	}
+	if got := files["base/service.yaml"]; strings.Contains(got, "environment") {
+		t.Errorf("base/service.yaml = %q, want the environment label stripped", got)
+	}
+	for env, replicas := range map[string]string{"dev": "1", "prod": "3"} {
+		dir := "overlays/" + env
+		checkContains(t, files, dir+"/kustomization.yaml", "resources:\n- ../../base\n- deployment.yaml\n")
+		checkContains(t, files, dir+"/deployment.yaml", "environment: "+env+"\n", "replicas: "+replicas)
+	}
+}
+
+const testUnorderedService = `kind: Service
+apiVersion: v1
+metadata:
+  name: web
+  # kept as written
+  annotations:
+    note:   "no managedFields here"
+spec:
+  type: ClusterIP
+  ports:
+    - port: 80`
+
+const testUnorderedManagedService = `kind: Service
+apiVersion: v1
+metadata:
+  name: api
+  managedFields:
+  - manager: kubectl
+  # kept as written
+  annotations:
+    note: x
+spec:
+  type: ClusterIP`
+
+func TestKeepKeyOrder(t *testing.T) {
+	files := build(t, testUnorderedService+"\n---\n"+testUnorderedManagedService+"\n")
+	if got := files["web.yaml"]; got != testUnorderedService {
+		t.Errorf("web.yaml = %q, want it as written %q", got, testUnorderedService)
+	}
+	want := "kind: Service\napiVersion: v1\nmetadata:\n  name: api\n  # kept as written\n  annotations:\n    note: x\nspec:\n  type: ClusterIP"
+	if got := files["api.yaml"]; got != want {
+		t.Errorf("api.yaml = %q, want %q", got, want)
+	}
+}
+
+func TestBuildTo(t *testing.T) {
+	b := NewBuilder()
+	if err := b.Process(strings.NewReader(testService)); err != nil {
+		t.Fatal(err)
+	}
+	var buf strings.Builder
+	if err := b.BuildTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+	want := "# --- service.yaml ---\n" + testService + "---\n" +
+		"# --- kustomization.yaml ---\napiVersion: kustomize.config.k8s.io/v1beta1\nkind: Kustomization\n\nresources:\n- service.yaml\n"
+	if got := buf.String(); got != want {
+		t.Errorf("BuildTo wrote %q, want %q", got, want)
+	}
+}
+
+func TestFlatLayoutGenerators(t *testing.T) {
+	files := build(t, testWebAndAPI+"---\n"+testConfigMapAndSecret, WithFlatLayout(true))
+	for name := range files {
+		if strings.Contains(name, "/") {
+			t.Errorf("%s written to a subdirectory, want all files in the root", name)
+		}
+	}
+	checkContains(t, files, "kustomization.yaml",
+		"resources:\n- api_service.yaml\n- web_deployment.yaml\n- web_service.yaml\n- web_serviceaccount.yaml\n",
+		"configMapGenerator:\n- name: app\n  files:\n  - app.conf\n",
+		"secretGenerator:\n- name: creds\n  files:\n  - token\n",
+	)
+	checkContains(t, files, "app.conf", "a=1")
+	checkContains(t, files, "token", "hello")
+}
+
+const testEmbeddedManifests = `apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: bundle
+data:
+  manifests.yaml: |
+    apiVersion: v1
+    kind: Service
+    metadata:
+      name: embedded
+    ---
+    apiVersion: v1
+    kind: ServiceAccount
+    metadata:
+      name: embedded
+  values.yaml: |
+    replicas: 3
+    image: nginx
+    pullPolicy: IfNotPresent
+    resources: {}
+    extra: a long enough value to go to a file
+`
+
+func TestRecursiveConfigMapSplit(t *testing.T) {
+	files := build(t, testEmbeddedManifests, WithRecursiveConfigMapSplit(true))
+	checkContains(t, files, "service.yaml", "kind: Service\nmetadata:\n  name: embedded")
+	checkContains(t, files, "serviceaccount.yaml", "kind: ServiceAccount\nmetadata:\n  name: embedded")
+	checkContains(t, files, "values.yaml", "replicas: 3\n")
+	checkContains(t, files, "kustomization.yaml", "resources:\n- service.yaml\n- serviceaccount.yaml\n", "  files:\n  - values.yaml\n")
+	if _, ok := files["manifests.yaml"]; ok {
+		t.Error("manifests.yaml written, want the embedded manifests split")
+	}
+
+	files = build(t, testEmbeddedManifests)
+	checkContains(t, files, "manifests.yaml", "name: embedded\n---\n")
+	if _, ok := files["service.yaml"]; ok {
+		t.Error("service.yaml written, want the embedded manifests kept by default")
+	}
+}
+
+func TestProcessFiles(t *testing.T) {
+	root := writeTree(t, map[string]string{
+		"service.yaml":    "apiVersion: v1\nkind: Service\nmetadata:\n  name: web\n  labels:\n    app: web\n",
+		"deployment.json": `{"apiVersion": "apps/v1", "kind": "Deployment", "metadata": {"name": "web", "labels": {"app": "web"}}}`,
+	})
+	b := NewBuilder()
+	for _, name := range []string{"service.yaml", "deployment.json", "service.yaml"} {
+		if err := b.ProcessFile(filepath.Join(root, name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	files := buildFiles(t, b)
+	checkContains(t, files, "web/kustomization.yaml", "resources:\n- deployment.yaml\n- service.yaml\n")
+	checkContains(t, files, "web/deployment.yaml", "kind: Deployment\n")
+}
+
+const testNamespacedWeb = `apiVersion: v1
+kind: Service
+metadata:
+  name: web
+  namespace: a
+  labels:
+    app: web
+---
+apiVersion: v1
+kind: Service
+metadata:
+  name: web
+  namespace: b
+  labels:
+    app: web
+---
+apiVersion: v1
+kind: Namespace
+metadata:
+  name: a
+`
+
+func TestLayoutByNamespace(t *testing.T) {
+	files := build(t, testNamespacedWeb, WithLayoutStrategy(LayoutByNamespace))
+	checkContains(t, files, "kustomization.yaml", "resources:\n- a\n- b\n- namespace.yaml\n")
+	for _, ns := range []string{"a", "b"} {
+		checkContains(t, files, ns+"/kustomization.yaml", "resources:\n- web\n")
+		checkContains(t, files, ns+"/web/service.yaml", "namespace: "+ns+"\n")
+	}
+}
+
+func TestGeneratedAnnotation(t *testing.T) {
+	input := testService + "---\n" + testPlainConfigMap
+	files := build(t, input, WithGeneratedAnnotation(true))
+	want := "apiVersion: v1\nkind: Service\nmetadata:\n  name: web\n  annotations:\n    kustomizily.io/generated: \"true\""
+	if got := files["service.yaml"]; got != want {
+		t.Errorf("service.yaml = %q, want %q", got, want)
+	}
+	if got := files["kustomization.yaml"]; strings.Contains(got, "kustomizily.io/generated") {
+		t.Errorf("kustomization.yaml = %q, want the generators left unstamped", got)
+	}
+	if again := build(t, input, WithGeneratedAnnotation(true)); !maps.Equal(again, files) {
+		t.Error("output changed between builds, want it stable without WithTimestamp")
+	}
+
+	files = build(t, input, WithGeneratedAnnotation(true), WithTimestamp(true))
+	checkContains(t, files, "service.yaml", "kustomizily.io/generated: \"true\"\n    kustomizily.io/generated-at: ")
+}
+
+const testTeamLabeledServices = `apiVersion: v1
+kind: Service
+metadata:
+  name: web
+  labels:
+    team.example.com/service: storefront
+    app.kubernetes.io/component: frontend
+---
+apiVersion: v1
+kind: Service
+metadata:
+  name: api
+  labels:
+    app: api
+`
+
+func TestRoutingLabels(t *testing.T) {
+	files := build(t, testTeamLabeledServices, WithRoutingLabels([]string{"team.example.com/service"}))
+	got := slices.Sorted(maps.Keys(files))
+	want := []string{"kustomization.yaml", "service.yaml", "storefront/kustomization.yaml", "storefront/service.yaml"}
+	if !slices.Equal(got, want) {
+		t.Errorf("files = %v, want %v", got, want)
+	}
+	checkContains(t, files, "service.yaml", "name: api\n")
+
+	files = build(t, testTeamLabeledServices)
+	for _, name := range []string{"frontend/service.yaml", "api/service.yaml"} {
+		if _, ok := files[name]; !ok {
+			t.Errorf("%s not written, want the default routing labels", name)
+		}
+	}
+}
+
+const testOutOfOrderService = `spec:
+  # the port
+  ports:
+  - port: 80
+    name: http
+metadata:
+  name: web
+kind: Service
+status: {}
+apiVersion: v1
+`
+
+func TestCanonicalKeyOrder(t *testing.T) {
+	files := build(t, testOutOfOrderService, WithCanonicalKeyOrder(true))
+	want := "apiVersion: v1\nkind: Service\nmetadata:\n  name: web\nspec:\n  # the port\n  ports:\n    - port: 80\n      name: http\nstatus: {}"
+	if got := files["service.yaml"]; got != want {
+		t.Errorf("service.yaml = %q, want %q", got, want)
+	}
+
+	files = build(t, testOutOfOrderService)
+	if got := files["service.yaml"]; !strings.HasPrefix(got, "spec:\n") {
+		t.Errorf("service.yaml = %q, want the keys left in order by default", got)
+	}
+}
+
+const testBatchWorkloads = `apiVersion: batch/v1
+kind: CronJob
+metadata:
+  name: cleanup
+  labels:
+    app: web
+---
+apiVersion: batch/v1
+kind: Job
+metadata:
+  name: migrate
+  labels:
+    app: web
+---
+apiVersion: example.com/v1
+kind: Workflow
+metadata:
+  name: report
+---
+apiVersion: v1
+kind: Service
+metadata:
+  name: web
+  labels:
+    app: web
+`
+
+func TestGroupBatch(t *testing.T) {
+	files := build(t, testBatchWorkloads, WithGroupBatch(true), WithBatchKinds([]string{"Workflow"}))
+	for _, name := range []string{"batch/cronjob.yaml", "batch/job.yaml", "batch/workflow.yaml", "web/service.yaml"} {
+		if _, ok := files[name]; !ok {
+			t.Errorf("%s not written", name)
+		}
+	}
+	checkContains(t, files, "kustomization.yaml", "resources:\n- batch\n- web\n")
+
+	files = build(t, testBatchWorkloads)
+	if _, ok := files["web/cronjob.yaml"]; !ok {
+		t.Error("web/cronjob.yaml not written, want the app label to group without the option")
+	}
+}
+
+const testWrappedBinarySecret = `apiVersion: v1
+kind: Secret
+metadata:
+  name: certs
+data:
+  key.der: |
+    AAECAwQFBgcICQoLDA0ODxAREhMU
+    FRYXGBkaGxwdHh8gISIjJCUmJygpKissLS4v
+  token: " aGVs bG8= "
+`
+
+func TestSecretBase64Whitespace(t *testing.T) {
+	files := build(t, testWrappedBinarySecret)
+	want := make([]byte, 48)
+	for i := range want {
+		want[i] = byte(i)
+	}
+	if got := files["key.der"]; got != string(want) {
+		t.Errorf("key.der = %q, want %q", got, want)
+	}
+	if got := files["token"]; got != "hello" {
+		t.Errorf("token = %q, want %q", got, "hello")
+	}
+
+	b := NewBuilder()
+	err := b.Process(strings.NewReader("apiVersion: v1\nkind: Secret\nmetadata:\n  name: certs\ndata:\n  key.der: not*base64\n"))
+	if err == nil || !strings.Contains(err.Error(), `secret certs: invalid base64 in data key "key.der"`) {
+		t.Errorf("Process = %v, want an error naming the secret and key", err)
+	}
+}
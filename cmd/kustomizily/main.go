@@ -3,22 +3,55 @@ package main
 import (
 	"flag"
 	"fmt"
-	"io"
+	"log"
 	"os"
+	"slices"
+	"strings"
 
 	"github.com/wzshiming/kustomizily"
 )
 
+// inputList collects the values of a flag that can be repeated or
+// hold a comma-separated list.
+type inputList []string
+
+func (l *inputList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *inputList) Set(value string) error {
+	*l = append(*l, strings.Split(value, ",")...)
+	return nil
+}
+
 var (
-	inputFile string
+	inputs    inputList
 	outputDir string
 	dryRun    bool
+	resolve   bool
+	threshold int
+	atomic    bool
+	preserve  bool
+	unchanged bool
+	noClobber bool
+	prune     bool
+	stdout    bool
+	noLabels  bool
 )
 
 func init() {
-	flag.StringVar(&inputFile, "i", "-", "Input k8s YAML file")
+	flag.Var(&inputs, "i", "Input k8s YAML or JSON file, or directory; repeat or separate with commas for several (default \"-\")")
 	flag.StringVar(&outputDir, "o", "./kustomizily", "Output directory")
 	flag.BoolVar(&dryRun, "d", false, "Dry run mode")
+	flag.BoolVar(&noLabels, "no-common-labels", false, "Don't add labels shared by all resources of a directory to the kustomization")
+	flag.BoolVar(&prune, "prune", false, "Remove files written by an earlier -prune run but not by this one")
+	flag.BoolVar(&preserve, "p", false, "Preserve the directories of an input directory as output directories")
+	flag.BoolVar(&stdout, "stdout", false, "Print the output files with their content instead of writing them")
+	flag.BoolVar(&resolve, "r", false, "Resolve resources referenced by Kustomization documents")
+	flag.BoolVar(&atomic, "transaction", false, "Write the output into a temporary directory, swapped in only if the build succeeds")
+	flag.BoolVar(&noClobber, "no-clobber", false, "Fail instead of overwriting output files whose content differs")
+	flag.BoolVar(&unchanged, "skip-unchanged", false, "Don't rewrite output directories whose files are all unchanged")
+	flag.IntVar(&threshold, "dir-per-kind-threshold", 0, "Split directories with more resources of mixed kinds than this into kind subdirectories")
 	flag.Parse()
 }
 
@@ -29,43 +62,86 @@ func main() {
 		os.Exit(1)
 	}
 
-	if inputFile == "" {
+	if len(inputs) == 0 {
+		inputs = inputList{"-"}
+	}
+	if slices.Contains(inputs, "") {
 		fmt.Println("Input file is required")
 		flag.PrintDefaults()
 		os.Exit(1)
 	}
 
-	var reader io.Reader
-	if inputFile == "-" {
-		reader = os.Stdin
+	var writeFile func(dir string, name string, data []byte) error
+	var fs *kustomizily.FS
+	if dryRun || stdout {
+		writeFile = kustomizily.NewDryRunFS(outputDir).WithContent(stdout).WriteFile
 	} else {
-		f, err := os.Open(inputFile)
+		fs = kustomizily.NewFS(outputDir).WithTransaction(atomic).WithNoClobber(noClobber)
+		writeFile = fs.WriteFile
+	}
+
+	opts := []kustomizily.Option{
+		kustomizily.WithLogger(log.New(os.Stderr, "", 0)),
+		kustomizily.WithResolveReferences(resolve),
+		kustomizily.WithAutoLayout(threshold),
+		kustomizily.WithFilenameDiagnostics(dryRun),
+		kustomizily.WithPreserveInputDirs(preserve),
+		kustomizily.WithHoistCommonLabels(!noLabels),
+	}
+	if unchanged {
+		var keep func(dir string, name string)
+		if fs != nil {
+			keep = fs.Keep
+		}
+		opts = append(opts, kustomizily.WithSkipUnchangedDirs(os.DirFS(outputDir), keep))
+	}
+	h := kustomizily.NewBuilder(opts...)
+
+	for _, input := range inputs {
+		err := process(h, input)
 		if err != nil {
 			fmt.Println(err)
 			os.Exit(1)
 		}
-		defer f.Close()
-		reader = f
-	}
-
-	var writeFile func(dir string, name string, data []byte) error
-	if dryRun {
-		writeFile = kustomizily.NewDryRunFS(outputDir).WriteFile
-	} else {
-		writeFile = kustomizily.NewFS(outputDir).WriteFile
 	}
 
-	h := kustomizily.NewBuilder()
-
-	err := h.Process(reader)
+	err := h.Build(writeFile)
 	if err != nil {
 		fmt.Println(err)
+		if fs != nil {
+			fs.Rollback()
+		}
 		os.Exit(1)
 	}
 
-	err = h.Build(writeFile)
+	if fs != nil {
+		err = fs.Commit()
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		if prune {
+			err = fs.Prune()
+			if err != nil {
+				fmt.Println(err)
+				os.Exit(1)
+			}
+		}
+	}
+}
+
+func process(h *kustomizily.Builder, input string) error {
+	if input == "-" {
+		return h.Process(os.Stdin)
+	}
+
+	info, err := os.Stat(input)
 	if err != nil {
-		fmt.Println(err)
-		os.Exit(1)
+		return err
 	}
+	if info.IsDir() {
+		return h.ProcessDir(input)
+	}
+
+	return h.ProcessFile(input)
 }
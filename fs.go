@@ -1,39 +1,262 @@
 package kustomizily
 
 import (
+	"archive/tar"
+	"bytes"
 	"fmt"
+	"io"
+	"io/fs"
+	"maps"
 	"os"
 	"path"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"time"
 )
 
 // FS implements a file system writer that creates directories and files on disk.
 type FS struct {
-	root string
-	dirs map[string]struct{}
+	root        string
+	dirs        map[string]struct{}
+	transaction bool
+	tmp         string
+	// written holds the paths, relative to the root, written in this run.
+	written map[string]struct{}
+
+	noClobber bool
 }
 
 // NewFS creates a new file system writer with the specified root directory.
 func NewFS(root string) *FS {
-	return &FS{root: root, dirs: map[string]struct{}{}}
+	return &FS{root: root, dirs: map[string]struct{}{}, written: map[string]struct{}{}}
+}
+
+// WithTransaction makes the FS write into a temporary directory next to the root,
+// which Commit swaps into place and Rollback removes, so a failed build leaves
+// the root untouched. Files of the root not written in this run, such as
+// hand-added ones, are carried over by Commit.
+func (f *FS) WithTransaction(transaction bool) *FS {
+	f.transaction = transaction
+	return f
+}
+
+// WithNoClobber makes WriteFile fail instead of overwriting an existing file
+// under the root whose content differs from the data, protecting hand-edited
+// files. Files with identical content are left untouched.
+func (f *FS) WithNoClobber(noClobber bool) *FS {
+	f.noClobber = noClobber
+	return f
 }
 
 // WriteFile writes data to a file in the specified directory under the FS root.
 func (f *FS) WriteFile(dir string, name string, data []byte) error {
+	root, err := f.writeRoot()
+	if err != nil {
+		return err
+	}
+	f.written[path.Join(dir, name)] = struct{}{}
+	if f.noClobber {
+		existing, err := os.ReadFile(path.Join(f.root, dir, name))
+		switch {
+		case err == nil && bytes.Equal(existing, data):
+			if !f.transaction {
+				return nil
+			}
+		case err == nil && f.noClobber:
+			return fmt.Errorf("refusing to overwrite %s: its content differs", path.Join(f.root, dir, name))
+		}
+	}
 	if _, ok := f.dirs[dir]; !ok {
 		f.dirs[dir] = struct{}{}
-		if err := os.MkdirAll(path.Join(f.root, dir), 0755); err != nil {
+		if err := os.MkdirAll(path.Join(root, dir), 0755); err != nil {
+			return err
+		}
+	}
+	return os.WriteFile(path.Join(root, dir, name), data, 0644)
+}
+
+// Keep records a file left as it is on disk as part of this run, so that
+// Prune doesn't remove it. It suits WithSkipUnchangedDirs; in a transaction
+// Commit carries the file over.
+func (f *FS) Keep(dir string, name string) {
+	f.written[path.Join(dir, name)] = struct{}{}
+}
+
+func (f *FS) writeRoot() (string, error) {
+	if !f.transaction {
+		return f.root, nil
+	}
+	if f.tmp == "" {
+		parent := path.Dir(path.Clean(f.root))
+		if err := os.MkdirAll(parent, 0755); err != nil {
+			return "", err
+		}
+		tmp, err := os.MkdirTemp(parent, "."+path.Base(f.root)+"-*")
+		if err != nil {
+			return "", err
+		}
+		if err := os.Chmod(tmp, 0755); err != nil {
+			os.RemoveAll(tmp)
+			return "", err
+		}
+		f.tmp = tmp
+	}
+	return f.tmp, nil
+}
+
+// manifestFilename is the file at the root recording the files written, for
+// Prune.
+const manifestFilename = ".kustomizily-manifest"
+
+// Prune removes the files left over from earlier runs: those recorded by the
+// previous Prune but not written in this run, along with the directories
+// this leaves empty. Files the tool didn't write, such as hand-added ones,
+// are left alone. It then records the files written in this run. Call it
+// after Commit when the FS is transactional.
+func (f *FS) Prune() error {
+	manifest := path.Join(f.root, manifestFilename)
+	data, err := os.ReadFile(manifest)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	for _, name := range strings.Split(string(data), "\n") {
+		if _, ok := f.written[name]; ok || name == "" || !filepath.IsLocal(filepath.FromSlash(name)) {
+			continue
+		}
+		err := os.Remove(path.Join(f.root, name))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		for dir := path.Dir(name); dir != "."; dir = path.Dir(dir) {
+			entries, err := os.ReadDir(path.Join(f.root, dir))
+			if err != nil || len(entries) > 0 {
+				break
+			}
+			if err := os.Remove(path.Join(f.root, dir)); err != nil {
+				return err
+			}
+		}
+	}
+
+	names := slices.Sorted(maps.Keys(f.written))
+	if err := os.MkdirAll(f.root, 0755); err != nil {
+		return err
+	}
+	return os.WriteFile(manifest, []byte(strings.Join(names, "\n")+"\n"), 0644)
+}
+
+// Commit copies the files of the root not written in the transaction into it,
+// then swaps the output written in it into place. The swap renames the root
+// aside and the output into its place: it isn't atomic, a crash in between
+// leaves the previous output in a ".<root>-*.old" directory next to the root.
+// It is a no-op when the FS isn't transactional.
+func (f *FS) Commit() error {
+	if f.tmp == "" {
+		return nil
+	}
+	tmp := f.tmp
+	f.tmp = ""
+	f.dirs = map[string]struct{}{}
+
+	if err := carryOver(f.root, tmp); err != nil {
+		os.RemoveAll(tmp)
+		return err
+	}
+
+	backup := tmp + ".old"
+	_, err := os.Stat(f.root)
+	switch {
+	case err == nil:
+		if err := os.Rename(f.root, backup); err != nil {
+			os.RemoveAll(tmp)
 			return err
 		}
+	case os.IsNotExist(err):
+		backup = ""
+	default:
+		os.RemoveAll(tmp)
+		return err
+	}
+
+	if err := os.Rename(tmp, f.root); err != nil {
+		if backup != "" {
+			os.Rename(backup, f.root)
+		}
+		os.RemoveAll(tmp)
+		return err
+	}
+	if backup != "" {
+		return os.RemoveAll(backup)
 	}
-	return os.WriteFile(path.Join(f.root, dir, name), data, 0644)
+	return nil
+}
+
+// carryOver copies the files under root missing from tmp into tmp.
+func carryOver(root, tmp string) error {
+	return filepath.WalkDir(root, func(name string, d fs.DirEntry, err error) error {
+		if os.IsNotExist(err) && name == root {
+			return filepath.SkipAll
+		}
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(root, name)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(tmp, rel)
+		if d.IsDir() {
+			if info, err := os.Lstat(target); err == nil && !info.IsDir() {
+				return filepath.SkipDir
+			}
+			return os.MkdirAll(target, 0755)
+		}
+		if _, err := os.Lstat(target); err == nil || !os.IsNotExist(err) {
+			return err
+		}
+		if d.Type()&fs.ModeSymlink != 0 {
+			link, err := os.Readlink(name)
+			if err != nil {
+				return err
+			}
+			return os.Symlink(link, target)
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		data, err := os.ReadFile(name)
+		if err != nil {
+			return err
+		}
+		return os.WriteFile(target, data, info.Mode().Perm())
+	})
+}
+
+// Rollback discards the output written in a transaction.
+// It is a no-op when the FS isn't transactional.
+func (f *FS) Rollback() error {
+	if f.tmp == "" {
+		return nil
+	}
+	tmp := f.tmp
+	f.tmp = ""
+	f.dirs = map[string]struct{}{}
+	return os.RemoveAll(tmp)
 }
 
 // DryRunFS implements a file system writer that simulates file operations,
 // printing actions to stdout instead of performing real disk operations.
 // Useful for previewing changes without modifying the filesystem.
 type DryRunFS struct {
-	root string
-	dirs map[string]struct{}
+	root    string
+	dirs    map[string]struct{}
+	content bool
 }
 
 // NewDryRunFS creates a new dry-run file system writer with the specified root.
@@ -41,8 +264,23 @@ func NewDryRunFS(root string) *DryRunFS {
 	return &DryRunFS{root: root, dirs: map[string]struct{}{}}
 }
 
+// WithContent makes the DryRunFS print each file as a "== path ==" banner
+// followed by its content, instead of the mkdir and write actions.
+func (d *DryRunFS) WithContent(content bool) *DryRunFS {
+	d.content = content
+	return d
+}
+
 // WriteFile logs the file creation operation to stdout without writing to disk.
 func (d *DryRunFS) WriteFile(dir string, name string, data []byte) error {
+	if d.content {
+		fmt.Printf("== %s ==\n", path.Join(d.root, dir, name))
+		os.Stdout.Write(data)
+		if len(data) > 0 && data[len(data)-1] != '\n' {
+			fmt.Println()
+		}
+		return nil
+	}
 	if _, ok := d.dirs[dir]; !ok {
 		d.dirs[dir] = struct{}{}
 		fmt.Println("mkdir", path.Join(d.root, dir))
@@ -50,3 +288,96 @@ func (d *DryRunFS) WriteFile(dir string, name string, data []byte) error {
 	fmt.Println("write", path.Join(d.root, dir, name))
 	return nil
 }
+
+// MemFS implements a file system writer that keeps the written files in memory.
+// Useful for embedding the package without touching the disk.
+type MemFS struct {
+	// Data holds the written files keyed by their path.
+	Data map[string][]byte
+}
+
+// NewMemFS creates a new in-memory file system writer.
+func NewMemFS() *MemFS {
+	return &MemFS{Data: map[string][]byte{}}
+}
+
+// WriteFile stores a copy of data under the path of the file.
+func (m *MemFS) WriteFile(dir string, name string, data []byte) error {
+	m.Data[path.Join(dir, name)] = bytes.Clone(data)
+	return nil
+}
+
+// MemFile is a file written to a MemFS.
+type MemFile struct {
+	Path string
+	Data []byte
+}
+
+// Files returns the written files sorted by path.
+func (m *MemFS) Files() []MemFile {
+	files := make([]MemFile, 0, len(m.Data))
+	for p, data := range m.Data {
+		files = append(files, MemFile{Path: p, Data: data})
+	}
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].Path < files[j].Path
+	})
+	return files
+}
+
+// TarFS implements a file system writer that writes the files into a tar
+// archive, adding entries for their directories as needed. Entries get a
+// fixed modification time so the same output gives the same archive.
+// Useful for shipping the output as a single artifact.
+type TarFS struct {
+	tw   *tar.Writer
+	dirs map[string]struct{}
+}
+
+// NewTarFS creates a new tar archive writer over w.
+func NewTarFS(w io.Writer) *TarFS {
+	return &TarFS{tw: tar.NewWriter(w), dirs: map[string]struct{}{}}
+}
+
+// WriteFile adds the file to the archive under its directory.
+func (t *TarFS) WriteFile(dir string, name string, data []byte) error {
+	if err := t.writeDir(path.Clean(dir)); err != nil {
+		return err
+	}
+	err := t.tw.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     path.Join(dir, name),
+		Mode:     0644,
+		Size:     int64(len(data)),
+		ModTime:  time.Unix(0, 0),
+	})
+	if err != nil {
+		return err
+	}
+	_, err = t.tw.Write(data)
+	return err
+}
+
+func (t *TarFS) writeDir(dir string) error {
+	if dir == "." || dir == "/" {
+		return nil
+	}
+	if _, ok := t.dirs[dir]; ok {
+		return nil
+	}
+	if err := t.writeDir(path.Dir(dir)); err != nil {
+		return err
+	}
+	t.dirs[dir] = struct{}{}
+	return t.tw.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeDir,
+		Name:     dir + "/",
+		Mode:     0755,
+		ModTime:  time.Unix(0, 0),
+	})
+}
+
+// Close writes the end of the archive. It doesn't close the underlying writer.
+func (t *TarFS) Close() error {
+	return t.tw.Close()
+}
@@ -0,0 +1,335 @@
+package kustomizily
+
+import (
+	"archive/tar"
+	"bytes"
+	"fmt"
+	"io"
+	"maps"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSkipUnchangedDirs(t *testing.T) {
+	root := t.TempDir()
+	build := func(input string) {
+		t.Helper()
+		fs := NewFS(root)
+		b := NewBuilder(WithAutoLayout(2), WithSkipUnchangedDirs(os.DirFS(root), fs.Keep))
+		if err := b.Process(strings.NewReader(input)); err != nil {
+			t.Fatal(err)
+		}
+		if err := b.Build(fs.WriteFile); err != nil {
+			t.Fatal(err)
+		}
+		if err := fs.Prune(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	build(testWebAndAPI)
+
+	old := time.Now().Add(-time.Hour).Truncate(time.Second)
+	names := []string{
+		"kustomization.yaml",
+		"api/kustomization.yaml",
+		"api/service.yaml",
+		"web/kustomization.yaml",
+		"web/service/service.yaml",
+	}
+	for _, name := range names {
+		if err := os.Chtimes(filepath.Join(root, name), old, old); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	build(strings.Replace(testWebAndAPI, "app: api", "app: api\n    tier: backend", 1))
+	for _, name := range names {
+		info, err := os.Stat(filepath.Join(root, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		rewritten := !info.ModTime().Equal(old)
+		if want := strings.HasPrefix(name, "api/"); rewritten != want {
+			t.Errorf("%s rewritten = %v, want %v", name, rewritten, want)
+		}
+	}
+	if data, _ := os.ReadFile(filepath.Join(root, "api/service.yaml")); !strings.Contains(string(data), "tier: backend") {
+		t.Errorf("api/service.yaml was not updated, got %q", data)
+	}
+}
+
+func TestFSPrune(t *testing.T) {
+	root := t.TempDir()
+	build := func(input string, opts ...Option) {
+		t.Helper()
+		b := NewBuilder(opts...)
+		if err := b.Process(strings.NewReader(input)); err != nil {
+			t.Fatal(err)
+		}
+		fs := NewFS(root)
+		if err := b.Build(fs.WriteFile); err != nil {
+			t.Fatal(err)
+		}
+		if err := fs.Prune(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	exists := func(name string) bool {
+		_, err := os.Stat(filepath.Join(root, name))
+		return err == nil
+	}
+
+	if err := os.WriteFile(filepath.Join(root, "README.md"), []byte("hand-written"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	build(testSameNameWorkload+"---\n"+testNamespacedRoles, WithLayoutStrategy(LayoutByNamespace))
+	if !exists("service.yaml") || !exists("deployment.yaml") || !exists("a/role.yaml") {
+		t.Fatal("files not written")
+	}
+
+	build(testService)
+	for _, name := range []string{"deployment.yaml", "a/role.yaml", "a"} {
+		if exists(name) {
+			t.Errorf("%s left over, want it pruned", name)
+		}
+	}
+	for _, name := range []string{"service.yaml", "kustomization.yaml", "README.md"} {
+		if !exists(name) {
+			t.Errorf("%s removed, want it kept", name)
+		}
+	}
+}
+
+func TestFSTransactionRollback(t *testing.T) {
+	parent := t.TempDir()
+	root := filepath.Join(parent, "out")
+	if err := os.Mkdir(root, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(root, "old.yaml"), []byte("old"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	b := NewBuilder(WithKustomizationPostProcess(func(dir string, data []byte) ([]byte, error) {
+		if dir == "web" {
+			return nil, fmt.Errorf("failed")
+		}
+		return data, nil
+	}))
+	if err := b.Process(strings.NewReader(testWebAndAPI)); err != nil {
+		t.Fatal(err)
+	}
+	fs := NewFS(root).WithTransaction(true)
+	if err := b.Build(fs.WriteFile); err == nil {
+		t.Fatal("Build succeeded, want the post-process error")
+	}
+	if err := fs.Rollback(); err != nil {
+		t.Fatal(err)
+	}
+
+	entries, err := os.ReadDir(parent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].Name() != "out" {
+		t.Errorf("parent holds %v, want only out", entries)
+	}
+	entries, err = os.ReadDir(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].Name() != "old.yaml" {
+		t.Errorf("root holds %v, want only old.yaml", entries)
+	}
+}
+
+func TestFSTransactionCommit(t *testing.T) {
+	root := filepath.Join(t.TempDir(), "out")
+	b := NewBuilder()
+	if err := b.Process(strings.NewReader(testService)); err != nil {
+		t.Fatal(err)
+	}
+	fs := NewFS(root).WithTransaction(true)
+	if err := b.Build(fs.WriteFile); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(root); !os.IsNotExist(err) {
+		t.Errorf("root exists before Commit: %v", err)
+	}
+	if err := fs.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"kustomization.yaml", "service.yaml"} {
+		if _, err := os.Stat(filepath.Join(root, name)); err != nil {
+			t.Error(err)
+		}
+	}
+}
+
+func TestFSTransactionCarryOver(t *testing.T) {
+	root := writeTree(t, map[string]string{
+		"README.md":          "hand-written",
+		"notes/todo.txt":     "hand-written",
+		"service.yaml":       "old",
+		"kustomization.yaml": "old",
+	})
+	b := NewBuilder()
+	if err := b.Process(strings.NewReader(testService)); err != nil {
+		t.Fatal(err)
+	}
+	fs := NewFS(root).WithTransaction(true)
+	if err := b.Build(fs.WriteFile); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	for name, want := range map[string]string{
+		"README.md":      "hand-written",
+		"notes/todo.txt": "hand-written",
+		"service.yaml":   testService[:len(testService)-1],
+	} {
+		if data, err := os.ReadFile(filepath.Join(root, name)); err != nil || string(data) != want {
+			t.Errorf("%s = %q, %v, want %q", name, data, err, want)
+		}
+	}
+	entries, err := os.ReadDir(filepath.Dir(root))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Errorf("parent holds %v, want only the root", entries)
+	}
+}
+
+func TestFSNoClobber(t *testing.T) {
+	root := t.TempDir()
+	fs := NewFS(root).WithNoClobber(true)
+	if err := fs.WriteFile("a", "new.yaml", []byte("new")); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := os.ReadFile(filepath.Join(root, "a", "new.yaml")); string(data) != "new" {
+		t.Errorf("new file = %q, want it written", data)
+	}
+
+	old := time.Now().Add(-time.Hour).Truncate(time.Second)
+	if err := os.Chtimes(filepath.Join(root, "a", "new.yaml"), old, old); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.WriteFile("a", "new.yaml", []byte("new")); err != nil {
+		t.Errorf("rewriting identical content: %v", err)
+	}
+	if info, err := os.Stat(filepath.Join(root, "a", "new.yaml")); err != nil || !info.ModTime().Equal(old) {
+		t.Errorf("identical file was rewritten: %v", err)
+	}
+
+	if err := os.WriteFile(filepath.Join(root, "edited.yaml"), []byte("hand-edited"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	err := fs.WriteFile("", "edited.yaml", []byte("generated"))
+	if err == nil || !strings.Contains(err.Error(), "refusing to overwrite") {
+		t.Errorf("WriteFile = %v, want a refusal to overwrite", err)
+	}
+	if data, _ := os.ReadFile(filepath.Join(root, "edited.yaml")); string(data) != "hand-edited" {
+		t.Errorf("edited file = %q, want it kept", data)
+	}
+}
+
+func TestTarFS(t *testing.T) {
+	b := NewBuilder()
+	if err := b.Process(strings.NewReader(testWebAndAPI)); err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	fs := NewTarFS(&buf)
+	if err := b.Build(fs.WriteFile); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	want := buildFiles(t, b)
+	got := map[string]string{}
+	dirs := map[string]bool{}
+	tr := tar.NewReader(&buf)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if hdr.Typeflag == tar.TypeDir {
+			dirs[hdr.Name] = true
+			continue
+		}
+		if dir := path.Dir(hdr.Name); dir != "." && !dirs[dir+"/"] {
+			t.Errorf("%s archived before its directory", hdr.Name)
+		}
+		data, err := io.ReadAll(tr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got[hdr.Name] = string(data)
+	}
+	if !maps.Equal(got, want) {
+		t.Errorf("archived %v, want %v", slices.Sorted(maps.Keys(got)), slices.Sorted(maps.Keys(want)))
+	}
+	if !dirs["web/"] || !dirs["api/"] {
+		t.Errorf("archived directories %v, want web/ and api/", dirs)
+	}
+}
+
+// captureStdout returns what f prints to os.Stdout.
+func captureStdout(t *testing.T, f func()) string {
+	t.Helper()
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout := os.Stdout
+	os.Stdout = w
+	defer func() {
+		os.Stdout = stdout
+	}()
+	done := make(chan []byte)
+	go func() {
+		data, _ := io.ReadAll(r)
+		done <- data
+	}()
+	f()
+	w.Close()
+	return string(<-done)
+}
+
+func TestDryRunFSContent(t *testing.T) {
+	build := func(fs *DryRunFS) {
+		t.Helper()
+		b := NewBuilder()
+		if err := b.Process(strings.NewReader(testService)); err != nil {
+			t.Fatal(err)
+		}
+		if err := b.Build(fs.WriteFile); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	got := captureStdout(t, func() { build(NewDryRunFS("out").WithContent(true)) })
+	want := "== out/service.yaml ==\n" + testService +
+		"== out/kustomization.yaml ==\napiVersion: kustomize.config.k8s.io/v1beta1\nkind: Kustomization\n\nresources:\n- service.yaml\n"
+	if got != want {
+		t.Errorf("printed %q, want %q", got, want)
+	}
+
+	got = captureStdout(t, func() { build(NewDryRunFS("out")) })
+	if want := "mkdir out\nwrite out/service.yaml\nwrite out/kustomization.yaml\n"; got != want {
+		t.Errorf("printed %q, want %q", got, want)
+	}
+}
@@ -2,13 +2,44 @@ package kustomizily
 
 import (
 	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
+	"maps"
+	"path"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"sort"
+	"strconv"
 	"strings"
+	"text/template"
+
+	"gopkg.in/yaml.v3"
 )
 
 type filesObject struct {
 	k8sObject *k8sObject
 	files     map[string][]byte
+	// literals holds the values written inline as key=value.
+	literals map[string]string
+	// envKey is the entry of files holding an env file, listed under envs.
+	envKey string
+	// suffixes holds an extra filename suffix per key, e.g. ".b64".
+	suffixes map[string]string
+}
+
+func (f *filesObject) filename(filenameFunc func(obj *k8sObject, key string) string, key string) string {
+	name := filenameFunc(f.k8sObject, key)
+	if name == "" {
+		return ""
+	}
+	return name + f.suffixes[key]
+}
+
+type replacementObject struct {
+	k8sObject *k8sObject
+	data      []byte
 }
 
 type kustomizationBuilder struct {
@@ -16,10 +47,27 @@ type kustomizationBuilder struct {
 	configMapObjects []*filesObject
 	secretObjects    []*filesObject
 	resources        []string
+	components       []string
+	component        bool
+	replacements     []*replacementObject
+	helmCharts       []*yaml.Node
+	sharedObjects    []*sharedObject
+	dir              string
+	opts             *options
+}
+
+// sharedObject is a resource of a directory moved by WithContentDedup into a
+// kustomization shared with other directories.
+type sharedObject struct {
+	// resource is the path of the shared kustomization.
+	resource string
+	// shared is the copy written there, obj the directory's own.
+	shared *k8sObject
+	obj    *k8sObject
 }
 
-func newKustomizationBuilder() *kustomizationBuilder {
-	return &kustomizationBuilder{}
+func newKustomizationBuilder(dir string, opts *options) *kustomizationBuilder {
+	return &kustomizationBuilder{dir: dir, opts: opts}
 }
 
 func (k *kustomizationBuilder) AddK8sObject(obj *k8sObject) {
@@ -38,7 +86,98 @@ func (k *kustomizationBuilder) AddResource(resource string) {
 	k.resources = append(k.resources, resource)
 }
 
+// AddSharedObject references the shared kustomization holding shared in
+// place of obj, the directory's own copy.
+func (k *kustomizationBuilder) AddSharedObject(resource string, shared, obj *k8sObject) {
+	k.AddResource(resource)
+	k.sharedObjects = append(k.sharedObjects, &sharedObject{resource: resource, shared: shared, obj: obj})
+}
+
+// hasObjectNamed reports whether an object of the directory other than obj,
+// shared ones included, has the given kind and name.
+func (k *kustomizationBuilder) hasObjectNamed(kind, name string, obj *k8sObject) bool {
+	objects := slices.Clone(k.k8sObjects)
+	for _, s := range k.sharedObjects {
+		objects = append(objects, s.obj)
+	}
+	return slices.ContainsFunc(objects, func(o *k8sObject) bool {
+		return o != obj && o.Kind == kind && o.Metadata.Name == name
+	})
+}
+
+func (k *kustomizationBuilder) RemoveResource(resource string) {
+	k.resources = slices.DeleteFunc(k.resources, func(r string) bool {
+		return r == resource
+	})
+	k.components = slices.DeleteFunc(k.components, func(r string) bool {
+		return r == resource
+	})
+}
+
+// RemoveObject drops obj from the resources, generators and replacements.
+func (k *kustomizationBuilder) RemoveObject(obj *k8sObject) {
+	k.k8sObjects = slices.DeleteFunc(k.k8sObjects, func(o *k8sObject) bool {
+		return o == obj
+	})
+	isObj := func(o *filesObject) bool {
+		return o.k8sObject == obj
+	}
+	k.configMapObjects = slices.DeleteFunc(k.configMapObjects, isObj)
+	k.secretObjects = slices.DeleteFunc(k.secretObjects, isObj)
+	k.replacements = slices.DeleteFunc(k.replacements, func(r *replacementObject) bool {
+		return r.k8sObject == obj
+	})
+}
+
+// MoveResourceToComponents lists a sub-directory under components instead of resources.
+func (k *kustomizationBuilder) MoveResourceToComponents(resource string) {
+	if slices.Contains(k.components, resource) {
+		return
+	}
+	k.RemoveResource(resource)
+	k.components = append(k.components, resource)
+}
+
+// SetComponent makes the kustomization a kustomize Component.
+func (k *kustomizationBuilder) SetComponent(component bool) {
+	k.component = component
+}
+
+// IsEmpty reports whether the kustomization has nothing to emit.
+func (k *kustomizationBuilder) IsEmpty() bool {
+	return len(k.k8sObjects) == 0 &&
+		len(k.configMapObjects) == 0 &&
+		len(k.secretObjects) == 0 &&
+		len(k.resources) == 0 &&
+		len(k.components) == 0 &&
+		len(k.replacements) == 0 &&
+		len(k.helmCharts) == 0
+}
+
+func (k *kustomizationBuilder) AddHelmChart(chart *yaml.Node) {
+	k.helmCharts = append(k.helmCharts, chart)
+}
+
+func (k *kustomizationBuilder) AddReplacement(obj *k8sObject, data []byte) {
+	k.replacements = append(k.replacements, &replacementObject{k8sObject: obj, data: data})
+}
+
 func (k *kustomizationBuilder) Build(writeFile func(name string, data []byte) error) error {
+	if err := k.validateGeneratorNames("configMapGenerator", k.configMapObjects); err != nil {
+		return err
+	}
+	if err := k.validateGeneratorNames("secretGenerator", k.secretObjects); err != nil {
+		return err
+	}
+	if err := k.validateGeneratorKeyRenames(); err != nil {
+		return err
+	}
+	if k.opts.forbidPlaintextSecrets {
+		if err := k.validateNoPlaintextSecrets(); err != nil {
+			return err
+		}
+	}
+
 	uniq := map[string]struct{}{
 		"kustomization.yaml": {},
 	}
@@ -46,45 +185,432 @@ func (k *kustomizationBuilder) Build(writeFile func(name string, data []byte) er
 	for _, resource := range k.resources {
 		uniq[resource] = struct{}{}
 	}
+	for _, component := range k.components {
+		uniq[component] = struct{}{}
+	}
+
+	if subdir := k.opts.generatorFilesSubdir; subdir != "" {
+		top := strings.SplitN(subdir, "/", 2)[0]
+		if _, ok := uniq[top]; ok {
+			return fmt.Errorf("generator files subdir %q conflicts with resource %q", subdir, top)
+		}
+		uniq[top] = struct{}{}
+	}
 
-	k8sObjectFilenameFunc := selectUniqueFilenameFuncForK8sObjects(k.k8sObjects, uniq)
-	if k8sObjectFilenameFunc == nil {
-		return fmt.Errorf("no unique filename for k8s objects")
+	k8sObjectFilenameFunc, err := k.selectK8sObjectFilenameFunc(uniq)
+	if err != nil {
+		return err
 	}
-	configMapObjectFilenameFunc := selectUniqueFilenameFuncForFiles(k.configMapObjects, uniq)
+	configMapObjectFilenameFunc, configMapStrategy := selectUniqueFilenameFuncForFiles(k.configMapObjects, uniq, k.generatorFilenameFuncs())
 	if configMapObjectFilenameFunc == nil {
 		return fmt.Errorf("no unique filename for config map objects")
 	}
-	secretObjectFilenameFunc := selectUniqueFilenameFuncForFiles(k.secretObjects, uniq)
+	secretObjectFilenameFunc, secretStrategy := selectUniqueFilenameFuncForFiles(k.secretObjects, uniq, k.generatorFilenameFuncs())
 	if secretObjectFilenameFunc == nil {
 		return fmt.Errorf("no unique filename for secret objects")
 	}
+	if k.opts.filenameDiagnostics {
+		if len(k.configMapObjects) > 0 {
+			k.opts.logger.Printf("%s: configMapGenerator uses %s filenames", k.displayDir(), configMapStrategy.describe(generatorFilenameStrategyNames))
+		}
+		if len(k.secretObjects) > 0 {
+			k.opts.logger.Printf("%s: secretGenerator uses %s filenames", k.displayDir(), secretStrategy.describe(generatorFilenameStrategyNames))
+		}
+	}
 
-	buf := bytes.NewBufferString("apiVersion: kustomize.config.k8s.io/v1beta1\nkind: Kustomization\n")
+	if k.opts.resourceListFile {
+		if _, ok := uniq[resourceListFilename]; ok {
+			return fmt.Errorf("resource list file %q conflicts with an existing entry", resourceListFilename)
+		}
+		uniq[resourceListFilename] = struct{}{}
+	}
 
-	if err := k.writeResources(buf, k.resources, k.k8sObjects, k8sObjectFilenameFunc, writeFile); err != nil {
-		return err
+	digests := map[string]fileDigest{}
+	if k.opts.resourceListFile {
+		write := writeFile
+		writeFile = func(name string, data []byte) error {
+			// Builder.Build converts the line endings on writing, the
+			// digests are taken of the converted data so they match.
+			digests[name] = newFileDigest(k.opts.convertLineEndings(data))
+			return write(name, data)
+		}
 	}
 
-	if err := k.writeGenerators(buf, "configMapGenerator", k.configMapObjects, configMapObjectFilenameFunc, writeFile); err != nil {
+	var buf *bytes.Buffer
+	if k.component {
+		buf = bytes.NewBufferString("apiVersion: kustomize.config.k8s.io/v1alpha1\nkind: Component\n")
+	} else {
+		buf = bytes.NewBufferString("apiVersion: kustomize.config.k8s.io/v1beta1\nkind: Kustomization\n")
+	}
+	if kustomizationName := k.opts.kustomizationName; kustomizationName != nil {
+		if name := kustomizationName(k.dir); name != "" {
+			fmt.Fprintf(buf, "metadata:\n  name: %s\n", yamlScalar(name))
+		}
+	}
+
+	namespace := k.commonNamespace()
+	if namespace != "" {
+		fmt.Fprintf(buf, "\nnamespace: %s\n", yamlScalar(namespace))
+	}
+
+	namePrefix := k.commonNamePrefix()
+	if namePrefix != "" {
+		fmt.Fprintf(buf, "\nnamePrefix: %s\n", yamlScalar(namePrefix))
+	}
+
+	labels := k.commonLabels()
+	// stripped are the labels removed from the resources, which the labels
+	// transformer adds back.
+	var stripped map[string]string
+	if k.opts.labelHoistStrip {
+		stripped = labels
+	}
+	common := k.commonGeneratorOptions(stripped)
+	common.namePrefix = namePrefix
+	sections := map[string]func() error{
+		"labels": func() error {
+			k.writeLabels(buf, labels)
+			return nil
+		},
+		"resources": func() error {
+			return k.writeResources(buf, k.resources, k.k8sObjects, stripped, namePrefix, k8sObjectFilenameFunc, writeFile)
+		},
+		"components": func() error {
+			k.writeComponents(buf, k.components)
+			return nil
+		},
+		"generatorOptions": func() error {
+			k.writeGeneratorOptions(buf, common)
+			return nil
+		},
+		"configMapGenerator": func() error {
+			return k.writeGenerators(buf, "configMapGenerator", k.configMapObjects, namespace, common, configMapObjectFilenameFunc, writeFile)
+		},
+		"secretGenerator": func() error {
+			return k.writeGenerators(buf, "secretGenerator", k.secretObjects, namespace, common, secretObjectFilenameFunc, writeFile)
+		},
+		"patches": func() error {
+			return k.writePatches(buf, k.patches())
+		},
+		"replacements": func() error {
+			return k.writeReplacements(buf, k.replacements, uniq, writeFile)
+		},
+		"helmCharts": func() error {
+			return k.writeHelmCharts(buf, k.helmCharts)
+		},
+		"sortOptions": func() error {
+			// kustomize only accepts sortOptions in the top-level kustomization,
+			// which is the overlay when there is one.
+			if k.dir == "" && k.opts.namespacedOverlay == nil && k.opts.sharedBase == "" {
+				k.writeSortOptions(buf, k.opts.sortOrder)
+			}
+			return nil
+		},
+	}
+	for _, section := range k.opts.sections() {
+		if err := sections[section](); err != nil {
+			return err
+		}
+	}
+
+	if k.opts.resourceListFile {
+		if err := k.writeResourceList(digests, k8sObjectFilenameFunc, configMapObjectFilenameFunc, secretObjectFilenameFunc, writeFile); err != nil {
+			return err
+		}
+	}
+
+	if err := validateKustomization(buf.Bytes()); err != nil {
 		return err
 	}
 
-	if err := k.writeGenerators(buf, "secretGenerator", k.secretObjects, secretObjectFilenameFunc, writeFile); err != nil {
+	data := buf.Bytes()
+	if postProcess := k.opts.kustomizationPostProcess; postProcess != nil {
+		var err error
+		data, err = postProcess(k.dir, data)
+		if err != nil {
+			return err
+		}
+	}
+
+	return writeFile("kustomization.yaml", data)
+}
+
+const (
+	overlayBaseDir = "base"
+	overlayDir     = "overlay"
+)
+
+// buildOverlayKustomization builds an overlay that layers a namespace and
+// name prefix on top of the base.
+func buildOverlayKustomization(namespace, namePrefix, sortOrder string) []byte {
+	buf := bytes.NewBufferString("apiVersion: kustomize.config.k8s.io/v1beta1\nkind: Kustomization\n\n")
+	if namespace != "" {
+		fmt.Fprintf(buf, "namespace: %s\n", yamlScalar(namespace))
+	}
+	if namePrefix != "" {
+		fmt.Fprintf(buf, "namePrefix: %s\n", yamlScalar(namePrefix))
+	}
+	fmt.Fprintf(buf, "\nresources:\n- ../%s\n", overlayBaseDir)
+	if sortOrder != "" {
+		fmt.Fprintf(buf, "\nsortOptions:\n  order: %s\n", sortOrder)
+	}
+	return buf.Bytes()
+}
+
+const fluxKustomizationFilename = "flux-kustomization.yaml"
+
+// buildFluxKustomization builds a Flux Kustomization applying the generated
+// kustomization at fluxPath of its source.
+func buildFluxKustomization(flux *fluxKustomization, fluxPath string) []byte {
+	buf := bytes.NewBufferString("apiVersion: kustomize.toolkit.fluxcd.io/v1\nkind: Kustomization\n")
+	fmt.Fprintf(buf, "metadata:\n  name: %s\n", yamlScalar(flux.name))
+	if flux.namespace != "" {
+		fmt.Fprintf(buf, "  namespace: %s\n", yamlScalar(flux.namespace))
+	}
+	buf.WriteString("spec:\n  interval: 10m\n")
+	fmt.Fprintf(buf, "  path: %s\n", yamlScalar(fluxPath))
+	buf.WriteString("  prune: true\n")
+	fmt.Fprintf(buf, "  sourceRef:\n    kind: %s\n    name: %s\n", yamlScalar(flux.sourceKind), yamlScalar(flux.sourceName))
+	return buf.Bytes()
+}
+
+const resourceListFilename = ".resource-list.yaml"
+
+type resourceListEntry struct {
+	APIVersion string `yaml:"apiVersion"`
+	Kind       string `yaml:"kind"`
+	Name       string `yaml:"name"`
+	Namespace  string `yaml:"namespace,omitempty"`
+	Filename   string `yaml:"filename,omitempty"`
+	// Shared is the shared kustomization holding the resource, for the
+	// resources moved there by WithContentDedup.
+	Shared string             `yaml:"shared,omitempty"`
+	SHA256 string             `yaml:"sha256,omitempty"`
+	Size   int                `yaml:"size,omitempty"`
+	Files  []resourceListFile `yaml:"files,omitempty"`
+}
+
+type resourceListFile struct {
+	Path   string `yaml:"path"`
+	SHA256 string `yaml:"sha256"`
+	Size   int    `yaml:"size"`
+}
+
+type resourceList struct {
+	Resources    []resourceListEntry `yaml:"resources,omitempty"`
+	Generators   []resourceListEntry `yaml:"generators,omitempty"`
+	Replacements []resourceListEntry `yaml:"replacements,omitempty"`
+}
+
+// fileDigest identifies the content of a written file.
+type fileDigest struct {
+	sha256 string
+	size   int
+}
+
+func newFileDigest(data []byte) fileDigest {
+	sum := sha256.Sum256(data)
+	return fileDigest{sha256: hex.EncodeToString(sum[:]), size: len(data)}
+}
+
+// writeResourceList writes an index of the resources, shared ones included,
+// generators and replacements of the directory, with the digests of the files
+// written for them.
+func (k *kustomizationBuilder) writeResourceList(digests map[string]fileDigest, k8sObjectFilenameFunc func(obj *k8sObject) string, configMapObjectFilenameFunc, secretObjectFilenameFunc func(obj *k8sObject, key string) string, writeFile func(name string, data []byte) error) error {
+	list := resourceList{}
+	for _, obj := range k.k8sObjects {
+		filename := k8sObjectFilenameFunc(obj)
+		list.Resources = append(list.Resources, resourceListEntry{
+			APIVersion: obj.APIVersion,
+			Kind:       obj.Kind,
+			Name:       obj.Metadata.Name,
+			Namespace:  obj.Metadata.Namespace,
+			Filename:   filename,
+			SHA256:     digests[filename].sha256,
+			Size:       digests[filename].size,
+		})
+	}
+	for _, shared := range k.sharedObjects {
+		list.Resources = append(list.Resources, resourceListEntry{
+			APIVersion: shared.obj.APIVersion,
+			Kind:       shared.obj.Kind,
+			Name:       shared.obj.Metadata.Name,
+			Namespace:  shared.obj.Metadata.Namespace,
+			Shared:     shared.resource,
+		})
+	}
+	addGenerators := func(objects []*filesObject, filenameFunc func(obj *k8sObject, key string) string) {
+		for _, obj := range objects {
+			entry := resourceListEntry{
+				APIVersion: obj.k8sObject.APIVersion,
+				Kind:       obj.k8sObject.Kind,
+				Name:       obj.k8sObject.Metadata.Name,
+				Namespace:  obj.k8sObject.Metadata.Namespace,
+			}
+			for key := range obj.files {
+				filePath := k.generatorFilePath(obj, filenameFunc, key)
+				entry.Files = append(entry.Files, resourceListFile{
+					Path:   filePath,
+					SHA256: digests[filePath].sha256,
+					Size:   digests[filePath].size,
+				})
+			}
+			sort.Slice(entry.Files, func(i, j int) bool {
+				return entry.Files[i].Path < entry.Files[j].Path
+			})
+			list.Generators = append(list.Generators, entry)
+		}
+	}
+	addGenerators(k.configMapObjects, configMapObjectFilenameFunc)
+	addGenerators(k.secretObjects, secretObjectFilenameFunc)
+	for _, replacement := range k.replacements {
+		filename := getReplacementFilename(replacement.k8sObject)
+		list.Replacements = append(list.Replacements, resourceListEntry{
+			APIVersion: replacement.k8sObject.APIVersion,
+			Kind:       replacement.k8sObject.Kind,
+			Name:       replacement.k8sObject.Metadata.Name,
+			Namespace:  replacement.k8sObject.Metadata.Namespace,
+			Filename:   filename,
+			SHA256:     digests[filename].sha256,
+			Size:       digests[filename].size,
+		})
+	}
+
+	data, err := marshalYAML(list)
+	if err != nil {
 		return err
 	}
+	return writeFile(resourceListFilename, data)
+}
 
-	return writeFile("kustomization.yaml", buf.Bytes())
+// validateKustomization guards against assembling malformed YAML.
+func validateKustomization(data []byte) error {
+	var kustomization map[string]any
+	if err := yaml.Unmarshal(data, &kustomization); err != nil {
+		return fmt.Errorf("generated invalid kustomization.yaml: %w", err)
+	}
+	return nil
 }
 
-func selectUniqueFilenameFuncForFiles(objects []*filesObject, uniq map[string]struct{}) func(obj *k8sObject, key string) string {
+// selectK8sObjectFilenameFunc names objects with a fixed filename or of kinds
+// with a filename template accordingly, and the rest through the default
+// strategy cascade.
+func (k *kustomizationBuilder) selectK8sObjectFilenameFunc(uniq map[string]struct{}) (func(obj *k8sObject) string, error) {
+	templated := map[*k8sObject]string{}
+	objects := make([]*k8sObject, 0, len(k.k8sObjects))
+	for _, obj := range k.k8sObjects {
+		name := obj.Filename
+		if name == "" {
+			tmpl, ok := k.opts.kindFilenameTemplates[obj.Kind]
+			if !ok {
+				objects = append(objects, obj)
+				continue
+			}
+			var err error
+			name, err = executeFilenameTemplate(tmpl, obj)
+			if err != nil {
+				return nil, err
+			}
+			if !isLocalFilename(name) {
+				return nil, fmt.Errorf("%s: invalid filename %q for %s %s", k.displayDir(), name, obj.Kind, obj.Metadata.Name)
+			}
+		}
+		if _, ok := uniq[name]; ok || name == "" {
+			return nil, fmt.Errorf("no unique filename for %s %s: %q", obj.Kind, obj.Metadata.Name, name)
+		}
+		uniq[name] = struct{}{}
+		templated[obj] = name
+	}
+
+	var fun func(obj *k8sObject) string
+	var strategy filenameStrategy
+	if k.opts.filenameSuffixDisambiguation {
+		fun, strategy = selectUniqueFilenameFuncForK8sObjects(objects, uniq, k8sObjectFilenameFuncs[:len(k8sObjectFilenameFuncs)-1])
+		if fun == nil {
+			fun = suffixDisambiguatedFilenameFunc(objects, uniq, getK8sObjectShortFilenameByNameAndKind)
+			strategy = filenameStrategy{index: 3, suffixed: true}
+		}
+	} else {
+		fun, strategy = selectUniqueFilenameFuncForK8sObjects(objects, uniq, k8sObjectFilenameFuncs)
+	}
+	if fun == nil {
+		return nil, fmt.Errorf("no unique filename for k8s objects")
+	}
+	if k.opts.filenameDiagnostics && len(objects) > 0 {
+		k.opts.logger.Printf("%s: resources use %s filenames", k.displayDir(), strategy.describe(k8sObjectFilenameStrategyNames))
+	}
+	if len(templated) == 0 {
+		return fun, nil
+	}
+	return func(obj *k8sObject) string {
+		if name, ok := templated[obj]; ok {
+			return name
+		}
+		return fun(obj)
+	}, nil
+}
+
+func (k *kustomizationBuilder) displayDir() string {
+	if k.dir == "" {
+		return "."
+	}
+	return k.dir
+}
+
+func (k *kustomizationBuilder) generatorFilenameFuncs() []func(obj *k8sObject, key string) string {
 	funcs := []func(obj *k8sObject, key string) string{
 		getGeneratorObjectShortFilenameByKey,
 		getGeneratorObjectShortFilenameByKeyAndKind,
 		getGeneratorObjectFilenameByKeyAndName,
 		getGeneratorObjectFilenameFull,
 	}
-	for _, fun := range funcs {
+	if rename := k.opts.generatorKeyRename; rename != nil {
+		for i, fun := range funcs {
+			funcs[i] = renameGeneratorObjectKey(fun, rename)
+		}
+	}
+	return funcs
+}
+
+// validateGeneratorKeyRenames rejects renamed generator files whose name
+// isn't a plain filename, which would be written outside the directory.
+func (k *kustomizationBuilder) validateGeneratorKeyRenames() error {
+	rename := k.opts.generatorKeyRename
+	if rename == nil {
+		return nil
+	}
+	for _, obj := range slices.Concat(k.configMapObjects, k.secretObjects) {
+		meta := obj.k8sObject.Metadata
+		for key := range obj.files {
+			name := rename(meta.Name, key)
+			if name == "" {
+				name = key
+			}
+			if !isLocalFilename(name) {
+				return fmt.Errorf("%s: invalid filename %q for key %q of %s %s", k.displayDir(), name, key, obj.k8sObject.Kind, meta.Name)
+			}
+		}
+	}
+	return nil
+}
+
+// isLocalFilename reports whether name is a plain filename, staying within
+// the directory it is written to.
+func isLocalFilename(name string) bool {
+	return filepath.IsLocal(name) && !strings.Contains(name, "/") && name != "."
+}
+
+func renameGeneratorObjectKey(fun func(obj *k8sObject, key string) string, rename func(name, key string) string) func(obj *k8sObject, key string) string {
+	return func(obj *k8sObject, key string) string {
+		if renamed := rename(obj.Metadata.Name, key); renamed != "" {
+			key = renamed
+		}
+		return fun(obj, key)
+	}
+}
+
+func selectUniqueFilenameFuncForFiles(objects []*filesObject, uniq map[string]struct{}, funcs []func(obj *k8sObject, key string) string) (func(obj *k8sObject, key string) string, filenameStrategy) {
+	for i, fun := range funcs {
 		items, ok := isUniqueFilenameFunc(objects, uniq, fun)
 		if !ok {
 			continue
@@ -93,26 +619,26 @@ func selectUniqueFilenameFuncForFiles(objects []*filesObject, uniq map[string]st
 		prefix := longestCommonPrefix(items)
 		if prefix == "" {
 			fillMap(uniq, items)
-			return fun
+			return fun, filenameStrategy{index: i}
 		}
 
 		index := indexOfSeparator(prefix)
 		if index <= 0 {
 			fillMap(uniq, items)
-			return fun
+			return fun, filenameStrategy{index: i}
 		}
 
 		newFunc := removeGeneratorObjectPrefix(fun, prefix[:index])
 		newItems, ok := isUniqueFilenameFunc(objects, uniq, newFunc)
-		if ok {
+		if ok && !hasMeaninglessName(newItems) {
 			fillMap(uniq, newItems)
-			return newFunc
+			return newFunc, filenameStrategy{index: i, prefix: prefix[:index]}
 		}
 
 		fillMap(uniq, items)
-		return fun
+		return fun, filenameStrategy{index: i}
 	}
-	return nil
+	return nil, filenameStrategy{index: -1}
 }
 
 func removeGeneratorObjectPrefix(fun func(obj *k8sObject, key string) string, prefix string) func(obj *k8sObject, key string) string {
@@ -126,7 +652,7 @@ func isUniqueFilenameFunc(objects []*filesObject, uniq map[string]struct{}, fun
 	localUniq := map[string]struct{}{}
 	for _, obj := range objects {
 		for key := range obj.files {
-			name := fun(obj.k8sObject, key)
+			name := obj.filename(fun, key)
 			if name == "" {
 				return nil, false
 			}
@@ -143,14 +669,56 @@ func isUniqueFilenameFunc(objects []*filesObject, uniq map[string]struct{}, fun
 	return items, true
 }
 
-func selectUniqueFilenameFuncForK8sObjects(objects []*k8sObject, uniq map[string]struct{}) func(obj *k8sObject) string {
-	funcs := []func(obj *k8sObject) string{
-		getCRDFilename,
-		getK8sObjectShortFilenameByKind,
-		getK8sObjectShortFilenameByName,
-		getK8sObjectShortFilenameByNameAndKind,
-		getK8sObjectFilenameFull,
+// k8sObjectFilenameFuncs are the filename strategies tried in order, from the
+// shortest to the most verbose. The CRD strategy must stay first.
+var k8sObjectFilenameFuncs = []func(obj *k8sObject) string{
+	getCRDFilename,
+	getK8sObjectShortFilenameByKind,
+	getK8sObjectShortFilenameByName,
+	getK8sObjectShortFilenameByNameAndKind,
+	getK8sObjectFilenameFull,
+}
+
+// k8sObjectFilenameStrategyNames names the strategies of k8sObjectFilenameFuncs.
+var k8sObjectFilenameStrategyNames = []string{
+	"crd",
+	"kind",
+	"name",
+	"name-and-kind",
+	"full",
+}
+
+// generatorFilenameStrategyNames names the strategies of generatorFilenameFuncs.
+var generatorFilenameStrategyNames = []string{
+	"key",
+	"kind-and-key",
+	"name-and-key",
+	"full",
+}
+
+// filenameStrategy describes the filename strategy selected for a set of objects.
+type filenameStrategy struct {
+	index  int
+	prefix string
+	// suffixed reports whether numeric suffixes disambiguate the names.
+	suffixed bool
+}
+
+func (s filenameStrategy) describe(names []string) string {
+	if s.index < 0 || s.index >= len(names) {
+		return "none"
+	}
+	desc := names[s.index]
+	if s.suffixed {
+		desc += " with numeric suffixes"
+	}
+	if s.prefix != "" {
+		desc += fmt.Sprintf(" (trimmed prefix %q)", s.prefix)
 	}
+	return desc
+}
+
+func selectUniqueFilenameFuncForK8sObjects(objects []*k8sObject, uniq map[string]struct{}, funcs []func(obj *k8sObject) string) (func(obj *k8sObject) string, filenameStrategy) {
 	for i, fun := range funcs {
 		items, ok := isUniqueFilenameFuncForK8sObjects(objects, uniq, fun)
 		if !ok {
@@ -159,32 +727,54 @@ func selectUniqueFilenameFuncForK8sObjects(objects []*k8sObject, uniq map[string
 
 		if i == 0 {
 			fillMap(uniq, items)
-			return fun
+			return fun, filenameStrategy{index: i}
 		}
 
 		prefix := longestCommonPrefix(items)
 		if prefix == "" {
 			fillMap(uniq, items)
-			return fun
+			return fun, filenameStrategy{index: i}
 		}
 
 		index := indexOfSeparator(prefix)
 		if index <= 0 {
 			fillMap(uniq, items)
-			return fun
+			return fun, filenameStrategy{index: i}
 		}
 
 		newFunc := removeK8sObjectsPrefix(fun, prefix[:index])
 		newItems, ok := isUniqueFilenameFuncForK8sObjects(objects, uniq, newFunc)
-		if ok {
+		if ok && !hasMeaninglessName(newItems) {
 			fillMap(uniq, newItems)
-			return newFunc
+			return newFunc, filenameStrategy{index: i, prefix: prefix[:index]}
 		}
 
 		fillMap(uniq, items)
-		return fun
+		return fun, filenameStrategy{index: i}
+	}
+	return nil, filenameStrategy{index: -1}
+}
+
+// suffixDisambiguatedFilenameFunc names objects with fun, appending -2, -3, ...
+// to names that are already taken.
+func suffixDisambiguatedFilenameFunc(objects []*k8sObject, uniq map[string]struct{}, fun func(obj *k8sObject) string) func(obj *k8sObject) string {
+	names := map[*k8sObject]string{}
+	for _, obj := range objects {
+		name := fun(obj)
+		ext := path.Ext(name)
+		stem := strings.TrimSuffix(name, ext)
+		for i := 2; ; i++ {
+			if _, ok := uniq[name]; !ok {
+				break
+			}
+			name = fmt.Sprintf("%s-%d%s", stem, i, ext)
+		}
+		uniq[name] = struct{}{}
+		names[obj] = name
+	}
+	return func(obj *k8sObject) string {
+		return names[obj]
 	}
-	return nil
 }
 
 func removeK8sObjectsPrefix(fun func(obj *k8sObject) string, prefix string) func(obj *k8sObject) string {
@@ -193,6 +783,18 @@ func removeK8sObjectsPrefix(fun func(obj *k8sObject) string, prefix string) func
 	}
 }
 
+// hasMeaninglessName reports whether trimming a common prefix left a name
+// without meaning, such as "0.yaml" out of "app-0.yaml".
+func hasMeaninglessName(items []string) bool {
+	for _, item := range items {
+		stem := strings.TrimSuffix(item, path.Ext(item))
+		if strings.Trim(stem, "0123456789-_.") == "" {
+			return true
+		}
+	}
+	return false
+}
+
 func fillMap(uniq map[string]struct{}, items []string) {
 	for _, item := range items {
 		uniq[item] = struct{}{}
@@ -219,42 +821,182 @@ func isUniqueFilenameFuncForK8sObjects(objects []*k8sObject, uniq map[string]str
 	return items, true
 }
 
-func (k *kustomizationBuilder) writeResources(buf *bytes.Buffer, resources []string, objects []*k8sObject, filenameFunc func(obj *k8sObject) string, writeFile func(name string, data []byte) error) error {
+func (k *kustomizationBuilder) writeResources(buf *bytes.Buffer, resources []string, objects []*k8sObject, labels map[string]string, namePrefix string, filenameFunc func(obj *k8sObject) string, writeFile func(name string, data []byte) error) error {
 	if len(resources) > 0 || len(objects) > 0 {
-		buf.WriteString("\nresources:\n")
+		k.writeSectionHeader(buf, "resources")
+		resources = slices.Clone(resources)
+		sort.Strings(resources)
 		for _, resource := range resources {
-			fmt.Fprintf(buf, "- %s\n", resource)
+			fmt.Fprintf(buf, "- %s\n", k.referencePath(resource))
 		}
-		for _, obj := range objects {
-			name := filenameFunc(obj)
-			if err := writeFile(name, obj.Raw); err != nil {
+		// With the fifo sort order kustomize emits resources in the order
+		// they are listed, so the input order is kept.
+		// Filenames are computed once, the sort would otherwise redo it
+		// for every comparison.
+		names := make([]string, len(objects))
+		for i, obj := range objects {
+			names[i] = filenameFunc(obj)
+		}
+		order := make([]int, len(objects))
+		for i := range order {
+			order[i] = i
+		}
+		if k.opts.sortOrder != "fifo" {
+			sort.SliceStable(order, func(i, j int) bool {
+				return names[order[i]] < names[order[j]]
+			})
+		}
+		for _, i := range order {
+			obj, name := objects[i], names[i]
+			data := obj.Raw
+			if len(labels) > 0 {
+				var err error
+				data, err = stripLabels(data, labels)
+				if err != nil {
+					return err
+				}
+			}
+			if namePrefix != "" {
+				var err error
+				data, err = stripNamePrefix(data, namePrefix)
+				if err != nil {
+					return err
+				}
+			}
+			if err := writeFile(name, data); err != nil {
 				return err
 			}
-			fmt.Fprintf(buf, "- %s\n", name)
+			fmt.Fprintf(buf, "- %s\n", k.referencePath(name))
 		}
 	}
 	return nil
 }
 
-func (k *kustomizationBuilder) writeGenerators(buf *bytes.Buffer, generatorType string, objects []*filesObject, filenameFunc func(obj *k8sObject, key string) string, writeFile func(name string, data []byte) error) error {
+// referencePath returns a local path as it is referenced from the
+// kustomization, prefixed with ./ when WithExplicitRelativePaths is set.
+// Remote, absolute and parent references are returned as is.
+func (k *kustomizationBuilder) referencePath(name string) string {
+	if !k.opts.explicitRelativePaths ||
+		strings.HasPrefix(name, "./") || strings.HasPrefix(name, "../") || strings.HasPrefix(name, "/") ||
+		isRemoteResource(name) {
+		return name
+	}
+	return "./" + name
+}
+
+var sectionComments = map[string]string{
+	"labels":             "Labels shared by all resources in this directory",
+	"resources":          "Resources included in this directory",
+	"components":         "Components applied on top of the resources",
+	"generatorOptions":   "Options shared by all generators",
+	"configMapGenerator": "ConfigMaps generated from the files in this directory",
+	"secretGenerator":    "Secrets generated from the files in this directory",
+	"replacements":       "Replacements copying fields between resources",
+	"patches":            "Patches applied to the resources",
+	"helmCharts":         "Helm charts inflated into resources",
+	"sortOptions":        "Order of the resources in the build output",
+}
+
+func (k *kustomizationBuilder) writeSectionHeader(buf *bytes.Buffer, section string) {
+	buf.WriteString("\n")
+	if k.opts.annotatedKustomization {
+		if comment, ok := sectionComments[section]; ok {
+			fmt.Fprintf(buf, "# %s\n", comment)
+		}
+	}
+	fmt.Fprintf(buf, "%s:\n", section)
+}
+
+// validateGeneratorNames rejects generators of the same type sharing a name
+// and namespace, which kustomize refuses to build.
+func (k *kustomizationBuilder) validateGeneratorNames(generatorType string, objects []*filesObject) error {
+	seen := map[string]struct{}{}
+	for _, obj := range objects {
+		meta := obj.k8sObject.Metadata
+		id := meta.Namespace + "/" + meta.Name
+		if _, ok := seen[id]; ok {
+			if meta.Namespace == "" {
+				return fmt.Errorf("%s: duplicate %s name %q", k.displayDir(), generatorType, meta.Name)
+			}
+			return fmt.Errorf("%s: duplicate %s name %q in namespace %q", k.displayDir(), generatorType, meta.Name, meta.Namespace)
+		}
+		seen[id] = struct{}{}
+	}
+	return nil
+}
+
+// validateNoPlaintextSecrets rejects secrets whose data would be written to
+// generator files in plaintext.
+func (k *kustomizationBuilder) validateNoPlaintextSecrets() error {
+	for _, obj := range k.secretObjects {
+		if len(obj.files) == 0 {
+			continue
+		}
+		meta := obj.k8sObject.Metadata
+		id := meta.Name
+		if meta.Namespace != "" {
+			id = meta.Namespace + "/" + id
+		}
+		return fmt.Errorf("%s: secret %s would be written in plaintext; encrypt it, e.g. as a SealedSecret or with SOPS, or remove it from the input", k.displayDir(), id)
+	}
+	return nil
+}
+
+func (k *kustomizationBuilder) writeSortOptions(buf *bytes.Buffer, order string) {
+	if order != "" {
+		k.writeSectionHeader(buf, "sortOptions")
+		fmt.Fprintf(buf, "  order: %s\n", order)
+	}
+}
+
+func (k *kustomizationBuilder) writeComponents(buf *bytes.Buffer, components []string) {
+	if len(components) > 0 {
+		k.writeSectionHeader(buf, "components")
+		components = slices.Clone(components)
+		sort.Strings(components)
+		for _, component := range components {
+			fmt.Fprintf(buf, "- %s\n", k.referencePath(component))
+		}
+	}
+}
+
+func (k *kustomizationBuilder) writeGenerators(buf *bytes.Buffer, generatorType string, objects []*filesObject, namespace string, common generatorOptions, filenameFunc func(obj *k8sObject, key string) string, writeFile func(name string, data []byte) error) error {
 	if len(objects) > 0 {
-		buf.WriteString(fmt.Sprintf("\n%s:\n", generatorType))
+		k.writeSectionHeader(buf, generatorType)
+		objects = slices.Clone(objects)
+		sort.SliceStable(objects, func(i, j int) bool {
+			a, b := objects[i].k8sObject.Metadata, objects[j].k8sObject.Metadata
+			if a.Name != b.Name {
+				return a.Name < b.Name
+			}
+			return a.Namespace < b.Namespace
+		})
 		for _, obj := range objects {
-			fmt.Fprintf(buf, "- name: %s\n", obj.k8sObject.Metadata.Name)
-			if obj.k8sObject.Metadata.Namespace != "" {
-				fmt.Fprintf(buf, "  namespace: %s\n", obj.k8sObject.Metadata.Namespace)
+			if !isValidResourceName(obj.k8sObject.Metadata.Name) {
+				k.opts.logger.Printf("warning: %s name %q is not a valid resource name", generatorType, obj.k8sObject.Metadata.Name)
+			}
+			fmt.Fprintf(buf, "- name: %s\n", yamlScalar(strings.TrimPrefix(obj.k8sObject.Metadata.Name, common.namePrefix)))
+			if ns := obj.k8sObject.Metadata.Namespace; ns != "" && ns != namespace {
+				fmt.Fprintf(buf, "  namespace: %s\n", yamlScalar(ns))
 			}
 			if generatorType == "secretGenerator" && obj.k8sObject.Type != "" {
 				fmt.Fprintf(buf, "  type: %s\n", obj.k8sObject.Type)
 			}
-			buf.WriteString("  options:\n")
-			buf.WriteString("    disableNameSuffixHash: true\n")
-			k.writeMapFields(buf, "annotations", obj.k8sObject.Metadata.Annotations)
-			k.writeMapFields(buf, "labels", obj.k8sObject.Metadata.Labels)
-			if obj.k8sObject.Immutable {
-				fmt.Fprintf(buf, "    immutable: true\n")
+			annotations := withoutEntries(obj.k8sObject.Metadata.Annotations, common.annotations)
+			labels := withoutEntries(withoutEntries(k.generatorLabels(obj.k8sObject), common.inherited), common.labels)
+			disableNameSuffixHash := !k.opts.minimalGenerators && !common.disableNameSuffixHash
+			if disableNameSuffixHash || len(annotations) > 0 || len(labels) > 0 || obj.k8sObject.Immutable {
+				buf.WriteString("  options:\n")
+				if disableNameSuffixHash {
+					buf.WriteString("    disableNameSuffixHash: true\n")
+				}
+				k.writeMapFields(buf, "    ", "annotations", annotations)
+				k.writeMapFields(buf, "    ", "labels", labels)
+				if obj.k8sObject.Immutable {
+					fmt.Fprintf(buf, "    immutable: true\n")
+				}
 			}
-			if err := k.writeFiles(buf, obj.files, filenameFunc, obj.k8sObject, writeFile); err != nil {
+			if err := k.writeFiles(buf, obj, filenameFunc, writeFile); err != nil {
 				return err
 			}
 		}
@@ -262,10 +1004,45 @@ func (k *kustomizationBuilder) writeGenerators(buf *bytes.Buffer, generatorType
 	return nil
 }
 
-func (k *kustomizationBuilder) writeFiles(buf *bytes.Buffer, files map[string][]byte, filenameFunc func(obj *k8sObject, key string) string, k8sObj *k8sObject, writeFile func(name string, data []byte) error) error {
+func (k *kustomizationBuilder) writeFiles(buf *bytes.Buffer, obj *filesObject, filenameFunc func(obj *k8sObject, key string) string, writeFile func(name string, data []byte) error) error {
+	if len(obj.literals) > 0 {
+		buf.WriteString("  literals:\n")
+		for _, key := range slices.Sorted(maps.Keys(obj.literals)) {
+			fmt.Fprintf(buf, "  - %s\n", yamlScalar(key+"="+obj.literals[key]))
+		}
+	}
+	if obj.envKey != "" {
+		name := k.generatorFilePath(obj, filenameFunc, obj.envKey)
+		if err := writeFile(name, obj.files[obj.envKey]); err != nil {
+			return err
+		}
+		buf.WriteString("  envs:\n")
+		fmt.Fprintf(buf, "  - %s\n", name)
+	}
+	keys := make([]string, 0, len(obj.files))
+	for key := range obj.files {
+		if key != obj.envKey {
+			keys = append(keys, key)
+		}
+	}
+	if len(keys) == 0 && (len(obj.literals) > 0 || obj.envKey != "") {
+		return nil
+	}
 	buf.WriteString("  files:\n")
-	for key, data := range files {
-		name := filenameFunc(k8sObj, key)
+	switch k.opts.generatorFilesOrder {
+	case GeneratorFilesByFilename:
+		sort.Slice(keys, func(i, j int) bool {
+			return k.generatorFilePath(obj, filenameFunc, keys[i]) < k.generatorFilePath(obj, filenameFunc, keys[j])
+		})
+	default:
+		sort.Strings(keys)
+	}
+	for _, key := range keys {
+		data := obj.files[key]
+		if k.opts.generatorProvenanceComment && obj.k8sObject.Kind == "ConfigMap" && !isBinary(data) {
+			data = append(provenanceComment(obj.k8sObject, key), data...)
+		}
+		name := k.generatorFilePath(obj, filenameFunc, key)
 		if err := writeFile(name, data); err != nil {
 			return err
 		}
@@ -278,31 +1055,477 @@ func (k *kustomizationBuilder) writeFiles(buf *bytes.Buffer, files map[string][]
 	return nil
 }
 
-func (k *kustomizationBuilder) writeMapFields(buf *bytes.Buffer, fieldName string, data map[string]string) {
+// provenanceComment names the ConfigMap and key a generator file was extracted from.
+func provenanceComment(obj *k8sObject, key string) []byte {
+	id := obj.Metadata.Name
+	if obj.Metadata.Namespace != "" {
+		id = obj.Metadata.Namespace + "/" + id
+	}
+	return []byte(fmt.Sprintf("# from configmap %s key %s\n", id, key))
+}
+
+func (k *kustomizationBuilder) generatorFilePath(obj *filesObject, filenameFunc func(obj *k8sObject, key string) string, key string) string {
+	name := obj.filename(filenameFunc, key)
+	if k.opts.generatorFilesSubdir != "" {
+		name = path.Join(k.opts.generatorFilesSubdir, name)
+	}
+	return name
+}
+
+func (k *kustomizationBuilder) writeReplacements(buf *bytes.Buffer, replacements []*replacementObject, uniq map[string]struct{}, writeFile func(name string, data []byte) error) error {
+	if len(replacements) > 0 {
+		k.writeSectionHeader(buf, "replacements")
+		for _, replacement := range replacements {
+			name := getReplacementFilename(replacement.k8sObject)
+			if _, ok := uniq[name]; ok {
+				return fmt.Errorf("no unique filename for replacement of %s %s", replacement.k8sObject.Kind, replacement.k8sObject.Metadata.Name)
+			}
+			uniq[name] = struct{}{}
+			if err := writeFile(name, replacement.data); err != nil {
+				return err
+			}
+			fmt.Fprintf(buf, "- path: %s\n", k.referencePath(name))
+		}
+	}
+	return nil
+}
+
+// kustomizePatch is an entry of the patches field.
+type kustomizePatch struct {
+	Path    string                `yaml:"path,omitempty"`
+	Patch   string                `yaml:"patch,omitempty"`
+	Target  *kustomizePatchTarget `yaml:"target,omitempty"`
+	Options map[string]bool       `yaml:"options,omitempty"`
+}
+
+type kustomizePatchTarget struct {
+	Group   string `yaml:"group,omitempty"`
+	Version string `yaml:"version,omitempty"`
+	Kind    string `yaml:"kind,omitempty"`
+	Name    string `yaml:"name,omitempty"`
+}
+
+// patches returns the patches generated for the resources of the directory.
+func (k *kustomizationBuilder) patches() []kustomizePatch {
+	var patches []kustomizePatch
+	// The shared objects are renamed first, so the patches below find them
+	// by the directory's names.
+	objects := slices.Clone(k.k8sObjects)
+	for _, s := range k.sharedObjects {
+		if patch, ok := buildSharedObjectPatch(s.shared, s.obj); ok {
+			patches = append(patches, patch)
+		}
+		objects = append(objects, s.obj)
+	}
+	if secret := k.opts.imagePullSecret; secret != "" {
+		for _, obj := range objects {
+			if obj.APIVersion != "v1" || obj.Kind != "ServiceAccount" {
+				continue
+			}
+			if patch, ok := buildImagePullSecretPatch(obj, secret); ok {
+				patches = append(patches, kustomizePatch{Patch: patch})
+			}
+		}
+	}
+	return patches
+}
+
+// buildSharedObjectPatch returns a JSON6902 patch giving shared the name and
+// namespace of obj, the copy of a directory, when they differ.
+func buildSharedObjectPatch(shared, obj *k8sObject) (kustomizePatch, bool) {
+	type operation struct {
+		Op    string `yaml:"op"`
+		Path  string `yaml:"path"`
+		Value string `yaml:"value"`
+	}
+	var operations []operation
+	var options map[string]bool
+	if obj.Metadata.Name != shared.Metadata.Name {
+		operations = append(operations, operation{Op: "replace", Path: "/metadata/name", Value: obj.Metadata.Name})
+		options = map[string]bool{"allowNameChange": true}
+	}
+	if obj.Metadata.Namespace != shared.Metadata.Namespace {
+		operations = append(operations, operation{Op: "add", Path: "/metadata/namespace", Value: obj.Metadata.Namespace})
+	}
+	if len(operations) == 0 {
+		return kustomizePatch{}, false
+	}
+	data, err := marshalYAML(operations)
+	if err != nil {
+		return kustomizePatch{}, false
+	}
+	group, version, ok := strings.Cut(shared.APIVersion, "/")
+	if !ok {
+		group, version = "", shared.APIVersion
+	}
+	return kustomizePatch{
+		Patch: string(data),
+		Target: &kustomizePatchTarget{
+			Group:   group,
+			Version: version,
+			Kind:    shared.Kind,
+			Name:    shared.Metadata.Name,
+		},
+		Options: options,
+	}, true
+}
+
+// buildImagePullSecretPatch builds a strategic-merge patch adding secret to
+// the imagePullSecrets of a ServiceAccount. The list has no merge key, so the
+// patch carries the existing entries too.
+func buildImagePullSecretPatch(obj *k8sObject, secret string) (string, bool) {
+	type localObjectReference struct {
+		Name string `yaml:"name"`
+	}
+	patch := struct {
+		APIVersion       string                 `yaml:"apiVersion"`
+		Kind             string                 `yaml:"kind"`
+		Metadata         metadata               `yaml:"metadata"`
+		ImagePullSecrets []localObjectReference `yaml:"imagePullSecrets"`
+	}{
+		APIVersion: obj.APIVersion,
+		Kind:       obj.Kind,
+	}
+	patch.Metadata.Name = obj.Metadata.Name
+	patch.Metadata.Namespace = obj.Metadata.Namespace
+	for _, ref := range obj.ImagePullSecrets {
+		if ref.Name == secret {
+			return "", false
+		}
+		patch.ImagePullSecrets = append(patch.ImagePullSecrets, localObjectReference{Name: ref.Name})
+	}
+	patch.ImagePullSecrets = append(patch.ImagePullSecrets, localObjectReference{Name: secret})
+
+	data, err := marshalYAML(patch)
+	if err != nil {
+		return "", false
+	}
+	return string(data), true
+}
+
+func (k *kustomizationBuilder) writePatches(buf *bytes.Buffer, patches []kustomizePatch) error {
+	if len(patches) > 0 {
+		data, err := marshalYAML(patches)
+		if err != nil {
+			return err
+		}
+		k.writeSectionHeader(buf, "patches")
+		buf.Write(data)
+	}
+	return nil
+}
+
+func (k *kustomizationBuilder) writeHelmCharts(buf *bytes.Buffer, charts []*yaml.Node) error {
+	if len(charts) > 0 {
+		data, err := encodeYAMLNode(&yaml.Node{Kind: yaml.SequenceNode, Content: charts})
+		if err != nil {
+			return err
+		}
+		k.writeSectionHeader(buf, "helmCharts")
+		buf.Write(data)
+		buf.WriteString("\n")
+	}
+	return nil
+}
+
+func (k *kustomizationBuilder) writeMapFields(buf *bytes.Buffer, indent string, fieldName string, data map[string]string) {
 	if len(data) > 0 {
-		fmt.Fprintf(buf, "    %s:\n", fieldName)
-		for key, value := range data {
-			fmt.Fprintf(buf, "      %q: %q\n", key, value)
+		fmt.Fprintf(buf, "%s%s:\n", indent, fieldName)
+		for _, key := range slices.Sorted(maps.Keys(data)) {
+			fmt.Fprintf(buf, "%s  %q: %q\n", indent, key, data[key])
 		}
 	}
 }
 
+// commonNamespace returns the namespace shared by all objects of the
+// directory, or "" when they don't all have the same one. With canonical
+// namespaces, objects without a namespace count as being in "default".
+// Directories including subdirectories or helm charts never have one, as
+// the namespace would apply to those too.
+func (k *kustomizationBuilder) commonNamespace() string {
+	if len(k.resources) > 0 || len(k.components) > 0 || len(k.helmCharts) > 0 {
+		return ""
+	}
+	objects := slices.Clone(k.k8sObjects)
+	for _, obj := range slices.Concat(k.configMapObjects, k.secretObjects) {
+		objects = append(objects, obj.k8sObject)
+	}
+	if len(objects) == 0 {
+		return ""
+	}
+	namespace := k.canonicalNamespace(objects[0].Metadata.Namespace)
+	for _, obj := range objects[1:] {
+		if k.canonicalNamespace(obj.Metadata.Namespace) != namespace {
+			return ""
+		}
+	}
+	if namespace == "default" && !slices.ContainsFunc(objects, func(obj *k8sObject) bool {
+		return obj.Metadata.Namespace == "default"
+	}) {
+		return ""
+	}
+	return namespace
+}
+
+// canonicalNamespace returns the namespace used when comparing namespaces.
+func (k *kustomizationBuilder) canonicalNamespace(namespace string) string {
+	if k.opts.canonicalNamespace && namespace == "" {
+		return "default"
+	}
+	return namespace
+}
+
+// generatorOptions holds the options shared by all generators of a directory.
+type generatorOptions struct {
+	disableNameSuffixHash bool
+	labels                map[string]string
+	annotations           map[string]string
+
+	// inherited are the labels set by the kustomization's labels, which
+	// aren't repeated in the generators.
+	inherited map[string]string
+	// namePrefix is set by the kustomization's namePrefix, and is stripped
+	// from the generator names.
+	namePrefix string
+}
+
+// commonGeneratorOptions returns the options shared by all generators of the
+// directory, when there are several of them.
+func (k *kustomizationBuilder) commonGeneratorOptions(inherited map[string]string) generatorOptions {
+	if !k.opts.hoistGeneratorOptions {
+		return generatorOptions{inherited: inherited}
+	}
+	objects := slices.Concat(k.configMapObjects, k.secretObjects)
+	if len(objects) < 2 {
+		return generatorOptions{inherited: inherited}
+	}
+	labels := make([]map[string]string, 0, len(objects))
+	annotations := make([]map[string]string, 0, len(objects))
+	for _, obj := range objects {
+		labels = append(labels, withoutEntries(k.generatorLabels(obj.k8sObject), inherited))
+		annotations = append(annotations, obj.k8sObject.Metadata.Annotations)
+	}
+	common := intersectEntries(annotations)
+	for _, key := range k.opts.noHoistAnnotations {
+		delete(common, key)
+	}
+	return generatorOptions{
+		disableNameSuffixHash: !k.opts.minimalGenerators,
+		labels:                intersectEntries(labels),
+		annotations:           common,
+		inherited:             inherited,
+	}
+}
+
+// generatorLabels returns the labels of the generator of obj: its own
+// labels merged over the ones set with WithGeneratorLabels.
+func (k *kustomizationBuilder) generatorLabels(obj *k8sObject) map[string]string {
+	if len(k.opts.generatorLabels) == 0 {
+		return obj.Metadata.Labels
+	}
+	labels := maps.Clone(k.opts.generatorLabels)
+	maps.Copy(labels, obj.Metadata.Labels)
+	return labels
+}
+
+// commonLabels returns the labels shared by all objects of the directory,
+// when there are several of them. Directories including subdirectories or
+// helm charts never have any, as the labels would apply to those too.
+func (k *kustomizationBuilder) commonLabels() map[string]string {
+	if !k.opts.hoistCommonLabels || len(k.resources) > 0 || len(k.components) > 0 || len(k.helmCharts) > 0 {
+		return nil
+	}
+	labels := make([]map[string]string, 0, len(k.k8sObjects)+len(k.configMapObjects)+len(k.secretObjects))
+	for _, obj := range k.k8sObjects {
+		labels = append(labels, obj.Metadata.Labels)
+	}
+	for _, obj := range slices.Concat(k.configMapObjects, k.secretObjects) {
+		labels = append(labels, obj.k8sObject.Metadata.Labels)
+	}
+	if len(labels) < 2 {
+		return nil
+	}
+	return intersectEntries(labels)
+}
+
+// writeLabels writes labels applied to the metadata of all resources only,
+// leaving selectors and templates untouched.
+func (k *kustomizationBuilder) writeLabels(buf *bytes.Buffer, labels map[string]string) {
+	if len(labels) > 0 {
+		k.writeSectionHeader(buf, "labels")
+		buf.WriteString("- pairs:\n")
+		keys := slices.Sorted(maps.Keys(labels))
+		for _, key := range keys {
+			fmt.Fprintf(buf, "    %q: %q\n", key, labels[key])
+		}
+	}
+}
+
+// commonNamePrefix returns the prefix, up to a "-", shared by the names of all
+// objects of the directory, when there are several of them. Directories
+// including subdirectories, helm charts or CRDs never have one, nor do those
+// whose objects mention the name of another one, as the reference wouldn't
+// follow the rename. Directories with generated patches don't either, as the
+// patches target the objects by their full names.
+func (k *kustomizationBuilder) commonNamePrefix() string {
+	if !k.opts.hoistNamePrefix || len(k.resources) > 0 || len(k.components) > 0 || len(k.helmCharts) > 0 {
+		return ""
+	}
+	if len(k.patches()) > 0 {
+		return ""
+	}
+	names := make([]string, 0, len(k.k8sObjects)+len(k.configMapObjects)+len(k.secretObjects))
+	contents := make([][][]byte, 0, cap(names))
+	for _, obj := range k.k8sObjects {
+		if isCRD(obj) {
+			return ""
+		}
+		names = append(names, obj.Metadata.Name)
+		contents = append(contents, [][]byte{obj.Raw})
+	}
+	for _, obj := range slices.Concat(k.configMapObjects, k.secretObjects) {
+		names = append(names, obj.k8sObject.Metadata.Name)
+		contents = append(contents, slices.Collect(maps.Values(obj.files)))
+	}
+	if len(names) < 2 {
+		return ""
+	}
+
+	prefix := names[0]
+	for _, name := range names[1:] {
+		i := 0
+		for i < len(prefix) && i < len(name) && prefix[i] == name[i] {
+			i++
+		}
+		prefix = prefix[:i]
+	}
+	i := strings.LastIndex(prefix, "-")
+	if i <= 0 {
+		return ""
+	}
+	prefix = prefix[:i+1]
+
+	for i, name := range names {
+		if name == prefix {
+			return ""
+		}
+		for j, content := range contents {
+			if i == j {
+				continue
+			}
+			for _, data := range content {
+				if bytes.Contains(data, []byte(name)) {
+					return ""
+				}
+			}
+		}
+	}
+	return prefix
+}
+
+// stripNamePrefix removes prefix from the name of a resource.
+func stripNamePrefix(data []byte, prefix string) ([]byte, error) {
+	return editYAML(data, func(node *yaml.Node) bool {
+		name := lookupMappingKey(lookupMappingKey(node, "metadata"), "name")
+		if name == nil || !strings.HasPrefix(name.Value, prefix) {
+			return false
+		}
+		name.Value = strings.TrimPrefix(name.Value, prefix)
+		return true
+	})
+}
+
+// stripLabels removes labels from the metadata of a resource.
+func stripLabels(data []byte, labels map[string]string) ([]byte, error) {
+	return editYAML(data, func(node *yaml.Node) bool {
+		meta := lookupMappingKey(node, "metadata")
+		changed := false
+		for key := range labels {
+			if deleteMappingKey(lookupMappingKey(meta, "labels"), key) {
+				changed = true
+			}
+		}
+		if l := lookupMappingKey(meta, "labels"); l != nil && len(l.Content) == 0 {
+			deleteMappingKey(meta, "labels")
+		}
+		return changed
+	})
+}
+
+func (k *kustomizationBuilder) writeGeneratorOptions(buf *bytes.Buffer, common generatorOptions) {
+	if common.disableNameSuffixHash || len(common.labels) > 0 || len(common.annotations) > 0 {
+		k.writeSectionHeader(buf, "generatorOptions")
+		if common.disableNameSuffixHash {
+			buf.WriteString("  disableNameSuffixHash: true\n")
+		}
+		k.writeMapFields(buf, "  ", "annotations", common.annotations)
+		k.writeMapFields(buf, "  ", "labels", common.labels)
+	}
+}
+
+// intersectEntries returns the entries present with the same value in all maps.
+func intersectEntries(maps []map[string]string) map[string]string {
+	if len(maps) == 0 {
+		return nil
+	}
+	common := map[string]string{}
+	for key, value := range maps[0] {
+		shared := true
+		for _, m := range maps[1:] {
+			if v, ok := m[key]; !ok || v != value {
+				shared = false
+				break
+			}
+		}
+		if shared {
+			common[key] = value
+		}
+	}
+	return common
+}
+
+// withoutEntries returns the entries of m that aren't in exclude.
+func withoutEntries(m map[string]string, exclude map[string]string) map[string]string {
+	if len(exclude) == 0 {
+		return m
+	}
+	rest := map[string]string{}
+	for key, value := range m {
+		if v, ok := exclude[key]; !ok || v != value {
+			rest[key] = value
+		}
+	}
+	return rest
+}
+
 func getGeneratorObjectShortFilenameByKey(obj *k8sObject, key string) string {
-	return key
+	return getGeneratorKeyFilename(obj, key)
 }
 
 func getGeneratorObjectShortFilenameByKeyAndKind(obj *k8sObject, key string) string {
 	kind := strings.ToLower(obj.Kind)
-	return fmt.Sprintf("%s_%s", kind, key)
+	return fmt.Sprintf("%s_%s", kind, getGeneratorKeyFilename(obj, key))
 }
 
 func getGeneratorObjectFilenameByKeyAndName(obj *k8sObject, key string) string {
-	return fmt.Sprintf("%s_%s", getShortName(obj), key)
+	return fmt.Sprintf("%s_%s", getShortName(obj), getGeneratorKeyFilename(obj, key))
 }
 
 func getGeneratorObjectFilenameFull(obj *k8sObject, key string) string {
 	kind := strings.ToLower(obj.Kind)
-	return fmt.Sprintf("%s_%s_%s", getShortName(obj), kind, key)
+	return fmt.Sprintf("%s_%s_%s", getShortName(obj), kind, getGeneratorKeyFilename(obj, key))
+}
+
+// getGeneratorKeyFilename maps the hidden keys of docker registry secrets
+// to readable filenames.
+func getGeneratorKeyFilename(obj *k8sObject, key string) string {
+	switch {
+	case obj.Type == "kubernetes.io/dockerconfigjson" && key == ".dockerconfigjson":
+		return "dockerconfigjson"
+	case obj.Type == "kubernetes.io/dockercfg" && key == ".dockercfg":
+		return "dockercfg"
+	}
+	return key
 }
 
 func getK8sObjectShortFilenameByKind(obj *k8sObject) string {
@@ -320,14 +1543,68 @@ func getK8sObjectShortFilenameByNameAndKind(obj *k8sObject) string {
 
 func getK8sObjectFilenameFull(obj *k8sObject) string {
 	kind := strings.ToLower(obj.Kind)
-	if !strings.Contains(obj.APIVersion, ".") && strings.HasSuffix(obj.APIVersion, "/v1") {
-		kind = fmt.Sprintf("%s_%s", strings.TrimSuffix(obj.APIVersion, "/v1"), kind)
-	} else if obj.APIVersion != "v1" {
-		kind = fmt.Sprintf("%s_%s", strings.ReplaceAll(obj.APIVersion, "/", "_"), kind)
+	if apiVersion := getAPIVersionFilenamePart(obj.APIVersion); apiVersion != "" {
+		kind = fmt.Sprintf("%s_%s", apiVersion, kind)
 	}
 	return fmt.Sprintf("%s_%s.yaml", getShortName(obj), kind)
 }
 
+// getAPIVersionFilenamePart returns the group and version of apiVersion joined
+// by "_" for use in filenames, leaving out the version when it is v1:
+//
+//	v1                           => ""
+//	v2                           => "v2"
+//	apps/v1                      => "apps"
+//	autoscaling/v2               => "autoscaling_v2"
+//	batch/v1                     => "batch"
+//	networking.k8s.io/v1         => "networking.k8s.io"
+//	rbac.authorization.k8s.io/v1 => "rbac.authorization.k8s.io"
+//	example.com/v1alpha1         => "example.com_v1alpha1"
+func getAPIVersionFilenamePart(apiVersion string) string {
+	group, version, ok := strings.Cut(apiVersion, "/")
+	if !ok {
+		group, version = "", apiVersion
+	}
+	if version == "v1" {
+		version = ""
+	}
+	switch {
+	case group == "":
+		return version
+	case version == "":
+		return group
+	default:
+		return group + "_" + version
+	}
+}
+
+func getReplacementFilename(obj *k8sObject) string {
+	return fmt.Sprintf("%s_%s_replacement.yaml", getShortName(obj), strings.ToLower(obj.Kind))
+}
+
+type filenameTemplateData struct {
+	Name       string
+	ShortName  string
+	Namespace  string
+	Kind       string
+	APIVersion string
+}
+
+func executeFilenameTemplate(tmpl *template.Template, obj *k8sObject) (string, error) {
+	var buf strings.Builder
+	err := tmpl.Execute(&buf, filenameTemplateData{
+		Name:       obj.Metadata.Name,
+		ShortName:  getShortName(obj),
+		Namespace:  obj.Metadata.Namespace,
+		Kind:       obj.Kind,
+		APIVersion: obj.APIVersion,
+	})
+	if err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
 func getCRDFilename(obj *k8sObject) string {
 	if obj.Spec.Group == "" || obj.Spec.Names.Plural == "" {
 		return ""
@@ -345,6 +1622,23 @@ func getShortName(obj *k8sObject) string {
 	return name
 }
 
+var resourceNameRegexp = regexp.MustCompile(`^[a-z0-9]([-a-z0-9]*[a-z0-9])?(\.[a-z0-9]([-a-z0-9]*[a-z0-9])?)*$`)
+
+// isValidResourceName reports whether name is a valid DNS subdomain,
+// which is what kustomize expects for generator names.
+func isValidResourceName(name string) bool {
+	return len(name) <= 253 && resourceNameRegexp.MatchString(name)
+}
+
+// yamlScalar formats s as a YAML scalar, quoting it when necessary.
+func yamlScalar(s string) string {
+	data, err := yaml.Marshal(s)
+	if err != nil {
+		return strconv.Quote(s)
+	}
+	return strings.TrimSuffix(string(data), "\n")
+}
+
 func indexOfSeparator(s string) int {
 	idx := strings.LastIndexAny(s, "-_")
 	if idx == -1 {
@@ -353,31 +1647,27 @@ func indexOfSeparator(s string) int {
 	return idx + 1
 }
 
+// longestCommonPrefix returns the prefix shared by all strs, treating '-' and
+// '_' as equal. The prefix only shrinks while scanning, so each string is
+// compared up to the current prefix and the scan stops once it is empty.
 func longestCommonPrefix(strs []string) string {
-	if len(strs) == 0 {
-		return ""
-	}
-	if len(strs) == 1 {
+	if len(strs) < 2 {
 		return ""
 	}
 
-	minLen := len(strs[0])
+	prefix := strs[0]
 	for _, s := range strs[1:] {
-		if len(s) < minLen {
-			minLen = len(s)
+		n := min(len(prefix), len(s))
+		i := 0
+		for i < n && charEqual(s[i], prefix[i]) {
+			i++
 		}
-	}
-
-	for i := 0; i < minLen; i++ {
-		char := strs[0][i]
-		for _, s := range strs[1:] {
-			if !charEqual(s[i], char) {
-				return strs[0][:i]
-			}
+		prefix = prefix[:i]
+		if prefix == "" {
+			return ""
 		}
 	}
-
-	return strs[0][:minLen]
+	return prefix
 }
 
 func charEqual(a, b byte) bool {
@@ -0,0 +1,1278 @@
+package kustomizily
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"log"
+	"maps"
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+
+	"gopkg.in/yaml.v3"
+)
+
+// columnCommonPrefix is the column-by-column implementation longestCommonPrefix
+// replaced, kept as a reference for its output.
+func columnCommonPrefix(strs []string) string {
+	if len(strs) < 2 {
+		return ""
+	}
+	minLen := len(strs[0])
+	for _, s := range strs[1:] {
+		minLen = min(minLen, len(s))
+	}
+	for i := 0; i < minLen; i++ {
+		for _, s := range strs[1:] {
+			if !charEqual(s[i], strs[0][i]) {
+				return strs[0][:i]
+			}
+		}
+	}
+	return strs[0][:minLen]
+}
+
+func TestLongestCommonPrefix(t *testing.T) {
+	tests := []struct {
+		strs []string
+		want string
+	}{
+		{nil, ""},
+		{[]string{"myapp-web"}, ""},
+		{[]string{"myapp-web", "myapp-api"}, "myapp-"},
+		{[]string{"myapp-web", "myapp_api"}, "myapp-"},
+		{[]string{"myapp", "myapp-web"}, "myapp"},
+		{[]string{"web", "api"}, ""},
+		{[]string{"a-b-c", "a-b-d", "a-x"}, "a-"},
+	}
+	for _, tt := range tests {
+		if got := longestCommonPrefix(tt.strs); got != tt.want {
+			t.Errorf("longestCommonPrefix(%q) = %q, want %q", tt.strs, got, tt.want)
+		}
+		if got := columnCommonPrefix(tt.strs); got != tt.want {
+			t.Errorf("columnCommonPrefix(%q) = %q, want %q", tt.strs, got, tt.want)
+		}
+	}
+
+	for _, strs := range [][]string{
+		testNames(5000, "myapp-web-%d"),
+		testNames(5000, "svc_%d-service.yaml"),
+		append(testNames(100, "prefix-%d"), "prefix_", "pre"),
+	} {
+		if got, want := longestCommonPrefix(strs), columnCommonPrefix(strs); got != want {
+			t.Errorf("got %q, want %q as before", got, want)
+		}
+	}
+}
+
+func testNames(n int, format string) []string {
+	names := make([]string, n)
+	for i := range names {
+		names[i] = fmt.Sprintf(format, i)
+	}
+	return names
+}
+
+func BenchmarkLongestCommonPrefix(b *testing.B) {
+	strs := testNames(5000, "myapp-web-%d")
+	b.Run("narrowing", func(b *testing.B) {
+		for range b.N {
+			longestCommonPrefix(strs)
+		}
+	})
+	b.Run("column", func(b *testing.B) {
+		for range b.N {
+			columnCommonPrefix(strs)
+		}
+	})
+}
+
+// BenchmarkBuild builds 5000 Services and 5000 Deployments sharing a name prefix.
+func BenchmarkBuild(b *testing.B) {
+	var input strings.Builder
+	for i := range 5000 {
+		fmt.Fprintf(&input, "---\napiVersion: v1\nkind: Service\nmetadata:\n  name: myapp-web-%d\n  labels:\n    app: web\n", i)
+		fmt.Fprintf(&input, "---\napiVersion: apps/v1\nkind: Deployment\nmetadata:\n  name: myapp-web-%d\n  labels:\n    app: web\n", i)
+	}
+	b.ResetTimer()
+	b.ReportAllocs()
+	for range b.N {
+		builder := NewBuilder()
+		if err := builder.Process(strings.NewReader(input.String())); err != nil {
+			b.Fatal(err)
+		}
+		if err := builder.Build(NewMemFS().WriteFile); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+const testUnsortedServices = `apiVersion: v1
+kind: Service
+metadata:
+  name: c
+---
+apiVersion: v1
+kind: Service
+metadata:
+  name: a
+---
+apiVersion: v1
+kind: Service
+metadata:
+  name: b
+`
+
+func TestWriteResourcesOrder(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		opts []Option
+		want string
+	}{
+		{
+			name: "sorted",
+			want: "resources:\n- a.yaml\n- b.yaml\n- c.yaml\n",
+		},
+		{
+			name: "fifo",
+			opts: []Option{WithSortOptions("fifo")},
+			want: "resources:\n- c.yaml\n- a.yaml\n- b.yaml\n",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			files := build(t, testUnsortedServices, tc.opts...)
+			got := files["kustomization.yaml"]
+			if !strings.Contains(got, tc.want) {
+				t.Errorf("kustomization.yaml = %q, want it to contain %q", got, tc.want)
+			}
+			for _, name := range []string{"a", "b", "c"} {
+				want := "apiVersion: v1\nkind: Service\nmetadata:\n  name: " + name
+				if got := files[name+".yaml"]; got != want {
+					t.Errorf("%s.yaml = %q, want %q", name, got, want)
+				}
+			}
+		})
+	}
+}
+
+const testServiceAndConfigMap = `apiVersion: v1
+kind: Service
+metadata:
+  name: web
+---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: web
+data:
+  config.yaml: |
+    a: 1
+    b: 2
+`
+
+func TestResourceListDigests(t *testing.T) {
+	files := build(t, testWebAndAPI, WithResourceListFile(true))
+	var list resourceList
+	if err := yaml.Unmarshal([]byte(files["web/"+resourceListFilename]), &list); err != nil {
+		t.Fatal(err)
+	}
+	if len(list.Resources) != 3 {
+		t.Fatalf("web lists %d resources, want 3", len(list.Resources))
+	}
+	for _, entry := range list.Resources {
+		data := files["web/"+entry.Filename]
+		sum := sha256.Sum256([]byte(data))
+		if want := hex.EncodeToString(sum[:]); entry.SHA256 != want {
+			t.Errorf("%s listed with sha256 %s, want %s", entry.Filename, entry.SHA256, want)
+		}
+		if entry.Size != len(data) {
+			t.Errorf("%s listed with size %d, want %d", entry.Filename, entry.Size, len(data))
+		}
+	}
+}
+
+func TestResourceListDigestsCRLF(t *testing.T) {
+	files := build(t, testServiceAndConfigMap, WithResourceListFile(true), WithLineEnding("crlf"))
+	var list resourceList
+	if err := yaml.Unmarshal([]byte(files[resourceListFilename]), &list); err != nil {
+		t.Fatal(err)
+	}
+	check := func(name, sum string, size int) {
+		t.Helper()
+		data, ok := files[name]
+		if !ok {
+			t.Errorf("%s listed but not written", name)
+			return
+		}
+		if !strings.Contains(data, "\r\n") {
+			t.Errorf("%s = %q, want CRLF line endings", name, data)
+		}
+		if want := newFileDigest([]byte(data)); sum != want.sha256 || size != want.size {
+			t.Errorf("%s listed with sha256 %s size %d, want %s size %d", name, sum, size, want.sha256, want.size)
+		}
+	}
+	var checked int
+	for _, entry := range slices.Concat(list.Resources, list.Generators) {
+		if entry.Filename != "" {
+			check(entry.Filename, entry.SHA256, entry.Size)
+			checked++
+		}
+		for _, file := range entry.Files {
+			check(file.Path, file.SHA256, file.Size)
+			checked++
+		}
+	}
+	if checked != 2 {
+		t.Errorf("checked %d files, want 2", checked)
+	}
+}
+
+func TestGetAPIVersionFilenamePart(t *testing.T) {
+	for _, tc := range []struct {
+		apiVersion string
+		kind       string
+		part       string
+		filename   string
+	}{
+		{"v1", "Service", "", "x_service.yaml"},
+		{"apps/v1", "Deployment", "apps", "x_apps_deployment.yaml"},
+		{"autoscaling/v2", "HorizontalPodAutoscaler", "autoscaling_v2", "x_autoscaling_v2_horizontalpodautoscaler.yaml"},
+		{"batch/v1", "Job", "batch", "x_batch_job.yaml"},
+		{"networking.k8s.io/v1", "Ingress", "networking.k8s.io", "x_networking.k8s.io_ingress.yaml"},
+		{"rbac.authorization.k8s.io/v1", "Role", "rbac.authorization.k8s.io", "x_rbac.authorization.k8s.io_role.yaml"},
+		{"example.com/v1alpha1", "Widget", "example.com_v1alpha1", "x_example.com_v1alpha1_widget.yaml"},
+	} {
+		t.Run(tc.apiVersion, func(t *testing.T) {
+			if got := getAPIVersionFilenamePart(tc.apiVersion); got != tc.part {
+				t.Errorf("getAPIVersionFilenamePart(%q) = %q, want %q", tc.apiVersion, got, tc.part)
+			}
+			obj := &k8sObject{APIVersion: tc.apiVersion, Kind: tc.kind}
+			obj.Metadata.Name = "x"
+			if got := getK8sObjectFilenameFull(obj); got != tc.filename {
+				t.Errorf("getK8sObjectFilenameFull = %q, want %q", got, tc.filename)
+			}
+		})
+	}
+}
+
+const testConfigMapAndSecret = `apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: app
+data:
+  app.conf: |
+    a=1
+    b=2
+---
+apiVersion: v1
+kind: Secret
+metadata:
+  name: creds
+data:
+  token: aGVsbG8=
+`
+
+func TestGeneratorFilesSubdir(t *testing.T) {
+	files := build(t, testConfigMapAndSecret, WithGeneratorFilesSubdir("_generated"))
+	checkContains(t, files, "_generated/app.conf", "a=1\nb=2")
+	checkContains(t, files, "_generated/token", "hello")
+	checkContains(t, files, "kustomization.yaml",
+		"  - app.conf=_generated/app.conf\n",
+		"  - token=_generated/token",
+	)
+	if _, ok := files["app.conf"]; ok {
+		t.Error("app.conf written at the root, want it under _generated")
+	}
+}
+
+func TestGeneratorKeyRename(t *testing.T) {
+	files := build(t, testConfigMapAndSecret, WithGeneratorKeyRename(func(name, key string) string {
+		if key == "app.conf" {
+			return name + "-config.ini"
+		}
+		return ""
+	}))
+	checkContains(t, files, "app-config.ini", "a=1")
+	checkContains(t, files, "token", "hello")
+	checkContains(t, files, "kustomization.yaml",
+		"  - app.conf=app-config.ini\n",
+		"  - token",
+	)
+	if _, ok := files["app.conf"]; ok {
+		t.Error("app.conf written, want it renamed")
+	}
+
+	for _, renamed := range []string{"../x", "a/b", "/etc/x", ".", ".."} {
+		b := NewBuilder(WithGeneratorKeyRename(func(name, key string) string {
+			return renamed
+		}))
+		if err := b.Process(strings.NewReader(testConfigMapAndSecret)); err != nil {
+			t.Fatal(err)
+		}
+		err := b.Build(NewMemFS().WriteFile)
+		if err == nil || !strings.Contains(err.Error(), "invalid filename") {
+			t.Errorf("Build with key renamed to %q = %v, want an invalid filename error", renamed, err)
+		}
+	}
+}
+
+func TestReplacementAnnotation(t *testing.T) {
+	const service = `apiVersion: v1
+kind: Service
+metadata:
+  name: web
+  annotations:
+    kustomizily.io/replacement: '%s'
+`
+	files := build(t, fmt.Sprintf(service, `{"source":{"kind":"Service","name":"web","fieldPath":"metadata.name"},"targets":[{"select":{"kind":"Deployment"},"fieldPaths":["spec.template.metadata.labels.svc"]}]}`))
+	checkContains(t, files, "kustomization.yaml", "replacements:\n- path: web_service_replacement.yaml\n")
+	checkContains(t, files, "web_service_replacement.yaml",
+		"source:\n  kind: Service\n  name: web\n  fieldPath: metadata.name\n",
+		"fieldPaths:\n      - spec.template.metadata.labels.svc",
+	)
+	if got, want := files["service.yaml"], "apiVersion: v1\nkind: Service\nmetadata:\n  name: web"; got != want {
+		t.Errorf("service.yaml = %q, want %q without the annotation", got, want)
+	}
+
+	b := NewBuilder()
+	if err := b.Process(strings.NewReader(fmt.Sprintf(service, `{"source":{"kind":"Service"}}`))); err == nil {
+		t.Error("Process of a replacement without targets succeeded, want an error")
+	}
+}
+
+func TestGeneratorOrder(t *testing.T) {
+	var input []string
+	for _, name := range []string{"c", "b", "a"} {
+		input = append(input, "apiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: "+name+"\ndata:\n  key: a long enough value to be written as a file, not as a literal\n")
+	}
+	files := build(t, strings.Join(input, "---\n"))
+	got := files["kustomization.yaml"]
+	a, b, c := strings.Index(got, "- name: a\n"), strings.Index(got, "- name: b\n"), strings.Index(got, "- name: c\n")
+	if a < 0 || !(a < b && b < c) {
+		t.Errorf("kustomization.yaml = %q, want generators a, b and c in order", got)
+	}
+}
+
+func TestInvalidGeneratorName(t *testing.T) {
+	var logs strings.Builder
+	files := build(t, `apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: app.config:v2
+data:
+  key: a long enough value to be written as a file, not as a literal
+`, WithLogger(log.New(&logs, "", 0)))
+	checkContains(t, files, "kustomization.yaml", "- name: app.config:v2\n")
+	if !strings.Contains(logs.String(), `configMapGenerator name "app.config:v2" is not a valid resource name`) {
+		t.Errorf("logged %q, want a warning about the name", logs.String())
+	}
+	for name := range files {
+		if strings.Contains(name, ":") {
+			t.Errorf("file %q contains a colon", name)
+		}
+	}
+}
+
+func TestDockerRegistrySecretFilenames(t *testing.T) {
+	for _, tc := range []struct {
+		typ, key, want string
+	}{
+		{"kubernetes.io/dockerconfigjson", ".dockerconfigjson", "  - .dockerconfigjson=dockerconfigjson\n"},
+		{"kubernetes.io/dockercfg", ".dockercfg", "  - .dockercfg=dockercfg\n"},
+		{"Opaque", ".dockerconfigjson", "  - .dockerconfigjson\n"},
+	} {
+		t.Run(tc.typ, func(t *testing.T) {
+			files := build(t, fmt.Sprintf("apiVersion: v1\nkind: Secret\nmetadata:\n  name: regcred\ntype: %s\ndata:\n  %s: e30=\n", tc.typ, tc.key))
+			checkContains(t, files, "kustomization.yaml", "  type: "+tc.typ+"\n", tc.want)
+		})
+	}
+}
+
+func TestValidateKustomization(t *testing.T) {
+	if err := validateKustomization([]byte("resources:\n- a.yaml\n")); err != nil {
+		t.Errorf("validateKustomization of valid YAML = %v", err)
+	}
+	if err := validateKustomization([]byte("resources:\n- a.yaml\n  b: c\n")); err == nil {
+		t.Error("validateKustomization of malformed YAML succeeded, want an error")
+	}
+
+	// Names YAML would read as other types, or not at all, must be quoted.
+	for _, name := range []string{"true", "123", "null", "a: b", "#x"} {
+		files := build(t, fmt.Sprintf("apiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: %q\n  namespace: %q\ndata:\n  key: a long enough value to be written as a file, not as a literal\n", name, name),
+			WithLogger(log.New(io.Discard, "", 0)))
+		var kustomization struct {
+			Namespace          string `yaml:"namespace"`
+			ConfigMapGenerator []struct {
+				Name string `yaml:"name"`
+			} `yaml:"configMapGenerator"`
+		}
+		if err := yaml.Unmarshal([]byte(files["kustomization.yaml"]), &kustomization); err != nil {
+			t.Fatalf("name %q: %v", name, err)
+		}
+		if g := kustomization.ConfigMapGenerator; len(g) != 1 || g[0].Name != name || kustomization.Namespace != name {
+			t.Errorf("name %q: kustomization = %+v", name, kustomization)
+		}
+	}
+}
+
+func TestHelmChartsPassthrough(t *testing.T) {
+	files := build(t, `apiVersion: kustomize.config.k8s.io/v1beta1
+kind: Kustomization
+helmCharts:
+- name: redis
+  repo: https://charts.bitnami.com/bitnami
+  version: 17.0.0
+  valuesInline:
+    replica:
+      replicaCount: 1
+---
+apiVersion: v1
+kind: Service
+metadata:
+  name: web
+`)
+	checkContains(t, files, "kustomization.yaml",
+		"resources:\n- service.yaml\n",
+		`helmCharts:
+- name: redis
+  repo: https://charts.bitnami.com/bitnami
+  version: 17.0.0
+  valuesInline:
+    replica:
+      replicaCount: 1
+`)
+}
+
+func TestKindFilenameTemplates(t *testing.T) {
+	files := build(t, testSameNameWorkload, WithKindFilenameTemplates(map[string]string{
+		"Deployment": "workload-{{.Name}}.yaml",
+	}))
+	got := slices.Sorted(maps.Keys(files))
+	want := []string{"kustomization.yaml", "service.yaml", "workload-web.yaml"}
+	if !slices.Equal(got, want) {
+		t.Errorf("files = %v, want %v", got, want)
+	}
+	checkContains(t, files, "workload-web.yaml", "kind: Deployment\n")
+
+	b := NewBuilder(WithKindFilenameTemplates(map[string]string{"Deployment": "{{.Name"}))
+	if err := b.Build(NewMemFS().WriteFile); err == nil {
+		t.Error("Build with an invalid template succeeded, want an error")
+	}
+
+	for _, tmpl := range []string{"../{{.Name}}.yaml", "/tmp/{{.Name}}.yaml", "{{.Namespace}}", "dir/{{.Name}}.yaml"} {
+		b := NewBuilder(WithKindFilenameTemplates(map[string]string{"Deployment": tmpl}))
+		if err := b.Process(strings.NewReader(testSameNameWorkload)); err != nil {
+			t.Fatal(err)
+		}
+		err := b.Build(NewMemFS().WriteFile)
+		if err == nil || !strings.Contains(err.Error(), "invalid filename") {
+			t.Errorf("Build with template %q = %v, want an invalid filename error", tmpl, err)
+		}
+	}
+}
+
+func TestKustomizationPostProcess(t *testing.T) {
+	var dirs []string
+	files := build(t, testWebAndAPI, WithKustomizationPostProcess(func(dir string, data []byte) ([]byte, error) {
+		dirs = append(dirs, dir)
+		return append([]byte("# Code generated by kustomizily. DO NOT EDIT.\n"), data...), nil
+	}))
+	for _, name := range []string{"kustomization.yaml", "api/kustomization.yaml", "web/kustomization.yaml"} {
+		if got := files[name]; !strings.HasPrefix(got, "# Code generated by kustomizily. DO NOT EDIT.\napiVersion: ") {
+			t.Errorf("%s = %q, want the header first", name, got)
+		}
+	}
+	slices.Sort(dirs)
+	if want := []string{"", "api", "web"}; !slices.Equal(dirs, want) {
+		t.Errorf("post-processed dirs = %q, want %q", dirs, want)
+	}
+
+	b := NewBuilder(WithKustomizationPostProcess(func(dir string, data []byte) ([]byte, error) {
+		return nil, fmt.Errorf("post-process failed")
+	}))
+	if err := b.Process(strings.NewReader(testService)); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Build(NewMemFS().WriteFile); err == nil || !strings.Contains(err.Error(), "post-process failed") {
+		t.Errorf("Build = %v, want the post-process error", err)
+	}
+}
+
+const testStringDataSecret = `apiVersion: v1
+kind: Secret
+metadata:
+  name: creds
+data:
+  bin: AAEKAgo=
+  token: aGVsbG8=
+stringData:
+  user: admin
+`
+
+func TestDecodeSecretsToText(t *testing.T) {
+	files := build(t, testStringDataSecret)
+	for name, want := range map[string]string{"bin": "\x00\x01\n\x02\n", "token": "hello", "user": "admin"} {
+		if got := files[name]; got != want {
+			t.Errorf("%s = %q, want %q", name, got, want)
+		}
+	}
+	checkContains(t, files, "kustomization.yaml", "  - bin\n  - token\n  - user\n")
+
+	files = build(t, testStringDataSecret, WithDecodeSecretsToText(true))
+	for name, want := range map[string]string{"bin.b64": "AAEKAgo=", "token": "hello", "user": "admin"} {
+		if got := files[name]; got != want {
+			t.Errorf("%s = %q, want %q", name, got, want)
+		}
+	}
+	if _, ok := files["bin"]; ok {
+		t.Error("bin written as binary, want it base64-encoded")
+	}
+	checkContains(t, files, "kustomization.yaml", "  - bin=bin.b64\n  - token\n  - user\n")
+}
+
+func TestAnnotatedKustomization(t *testing.T) {
+	input := testConfigMapAndSecret + "---\n" + testService
+	files := build(t, input, WithAnnotatedKustomization(true))
+	checkContains(t, files, "kustomization.yaml",
+		"# Resources included in this directory\nresources:\n",
+		"# Options shared by all generators\ngeneratorOptions:\n",
+		"# ConfigMaps generated from the files in this directory\nconfigMapGenerator:\n",
+		"# Secrets generated from the files in this directory\nsecretGenerator:\n",
+	)
+
+	files = build(t, input)
+	if got := files["kustomization.yaml"]; strings.Contains(got, "#") {
+		t.Errorf("kustomization.yaml = %q, want no comments by default", got)
+	}
+}
+
+func TestResourceListFile(t *testing.T) {
+	files := build(t, testWebAndAPI, WithResourceListFile(true))
+	for _, tc := range []struct {
+		dir  string
+		want []resourceListEntry
+	}{
+		{
+			dir: "api",
+			want: []resourceListEntry{
+				{APIVersion: "v1", Kind: "Service", Name: "api", Filename: "service.yaml"},
+			},
+		},
+		{
+			dir: "web",
+			want: []resourceListEntry{
+				{APIVersion: "v1", Kind: "Service", Name: "web", Filename: "service.yaml"},
+				{APIVersion: "apps/v1", Kind: "Deployment", Name: "web", Filename: "deployment.yaml"},
+				{APIVersion: "v1", Kind: "ServiceAccount", Name: "web", Filename: "serviceaccount.yaml"},
+			},
+		},
+	} {
+		var list resourceList
+		if err := yaml.Unmarshal([]byte(files[tc.dir+"/"+resourceListFilename]), &list); err != nil {
+			t.Fatal(err)
+		}
+		var got []resourceListEntry
+		for _, entry := range list.Resources {
+			entry.SHA256, entry.Size = "", 0
+			got = append(got, entry)
+		}
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%s resources = %+v, want %+v", tc.dir, got, tc.want)
+		}
+	}
+	if _, ok := files[resourceListFilename]; !ok {
+		t.Errorf("missing root %s", resourceListFilename)
+	}
+}
+
+func TestResourceListSharedAndReplacements(t *testing.T) {
+	files := build(t, testNamespacedRoles, WithLayoutStrategy(LayoutByNamespace), WithContentDedup("shared"), WithResourceListFile(true))
+	var list resourceList
+	if err := yaml.Unmarshal([]byte(files["b/"+resourceListFilename]), &list); err != nil {
+		t.Fatal(err)
+	}
+	want := resourceListEntry{APIVersion: "rbac.authorization.k8s.io/v1", Kind: "Role", Name: "pod-reader", Namespace: "b", Shared: "../shared/reader_role"}
+	if !slices.ContainsFunc(list.Resources, func(entry resourceListEntry) bool { return reflect.DeepEqual(entry, want) }) {
+		t.Errorf("b resources = %+v, want them to contain %+v", list.Resources, want)
+	}
+
+	files = build(t, `apiVersion: v1
+kind: Service
+metadata:
+  name: web
+  annotations:
+    kustomizily.io/replacement: '{"source":{"kind":"Service","name":"web"},"targets":[{"select":{"kind":"Deployment"},"fieldPaths":["metadata.name"]}]}'
+`, WithResourceListFile(true))
+	list = resourceList{}
+	if err := yaml.Unmarshal([]byte(files[resourceListFilename]), &list); err != nil {
+		t.Fatal(err)
+	}
+	digest := newFileDigest([]byte(files["web_service_replacement.yaml"]))
+	want = resourceListEntry{APIVersion: "v1", Kind: "Service", Name: "web", Filename: "web_service_replacement.yaml", SHA256: digest.sha256, Size: digest.size}
+	if !reflect.DeepEqual(list.Replacements, []resourceListEntry{want}) {
+		t.Errorf("replacements = %+v, want [%+v]", list.Replacements, want)
+	}
+}
+
+const testNamespacedServices = `apiVersion: v1
+kind: Service
+metadata:
+  name: web
+  namespace: a
+---
+apiVersion: v1
+kind: Service
+metadata:
+  name: web
+  namespace: b
+`
+
+func TestFilenameSuffixDisambiguation(t *testing.T) {
+	b := NewBuilder()
+	if err := b.Process(strings.NewReader(testNamespacedServices)); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Build(NewMemFS().WriteFile); err == nil || !strings.Contains(err.Error(), "no unique filename") {
+		t.Errorf("Build = %v, want a no unique filename error", err)
+	}
+
+	files := build(t, testNamespacedServices, WithFilenameSuffixDisambiguation(true))
+	checkContains(t, files, "web_service.yaml", "namespace: a")
+	checkContains(t, files, "web_service-2.yaml", "namespace: b")
+	checkContains(t, files, "kustomization.yaml", "resources:\n- web_service-2.yaml\n- web_service.yaml\n")
+}
+
+func TestFilenameDiagnostics(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		input string
+		opts  []Option
+		want  []string
+	}{
+		{
+			name:  "kind",
+			input: testSameNameWorkload,
+			want:  []string{".: resources use kind filenames\n"},
+		},
+		{
+			name:  "suffixed",
+			input: testNamespacedServices,
+			opts:  []Option{WithFilenameSuffixDisambiguation(true)},
+			want:  []string{".: resources use name-and-kind with numeric suffixes filenames\n"},
+		},
+		{
+			name:  "generators",
+			input: testConfigMapAndSecret,
+			want: []string{
+				".: configMapGenerator uses key filenames\n",
+				".: secretGenerator uses key filenames\n",
+			},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var logs strings.Builder
+			build(t, tc.input, append(tc.opts, WithFilenameDiagnostics(true), WithLogger(log.New(&logs, "", 0)))...)
+			for _, want := range tc.want {
+				if !strings.Contains(logs.String(), want) {
+					t.Errorf("logged %q, want %q", logs.String(), want)
+				}
+			}
+		})
+	}
+}
+
+func TestImagePullSecretPatch(t *testing.T) {
+	files := build(t, testWebAndAPI, WithImagePullSecret("regcred"))
+	checkContains(t, files, "web/kustomization.yaml", `patches:
+- patch: |
+    apiVersion: v1
+    kind: ServiceAccount
+    metadata:
+      name: web
+    imagePullSecrets:
+      - name: regcred
+`)
+	if got := files["api/kustomization.yaml"]; strings.Contains(got, "patches:") {
+		t.Errorf("api/kustomization.yaml = %q, want no patches without a ServiceAccount", got)
+	}
+
+	// A ServiceAccount already referencing the secret isn't patched.
+	files = build(t, "apiVersion: v1\nkind: ServiceAccount\nmetadata:\n  name: web\nimagePullSecrets:\n- name: regcred\n", WithImagePullSecret("regcred"))
+	if got := files["kustomization.yaml"]; strings.Contains(got, "patches:") {
+		t.Errorf("kustomization.yaml = %q, want no patches", got)
+	}
+}
+
+func TestSectionOrder(t *testing.T) {
+	index := func(t *testing.T, data string, sections ...string) []int {
+		t.Helper()
+		var indexes []int
+		for _, section := range sections {
+			i := strings.Index(data, "\n"+section+":\n")
+			if i < 0 {
+				t.Fatalf("kustomization.yaml = %q, want a %s section", data, section)
+			}
+			indexes = append(indexes, i)
+		}
+		return indexes
+	}
+	input := testConfigMapAndSecret + "---\n" + testService
+
+	files := build(t, input)
+	if got := index(t, files["kustomization.yaml"], "resources", "configMapGenerator", "secretGenerator"); !slices.IsSorted(got) {
+		t.Errorf("default sections out of order: %v", got)
+	}
+
+	files = build(t, input, WithSectionOrder([]string{"secretGenerator", "configMapGenerator"}))
+	if got := index(t, files["kustomization.yaml"], "secretGenerator", "configMapGenerator", "resources"); !slices.IsSorted(got) {
+		t.Errorf("reordered sections out of order: %v", got)
+	}
+
+	b := NewBuilder(WithSectionOrder([]string{"secretGenerators"}))
+	if err := b.Build(NewMemFS().WriteFile); err == nil {
+		t.Error("Build with an unknown section succeeded, want an error")
+	}
+}
+
+func TestSplitTLSChain(t *testing.T) {
+	leaf := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: []byte("leaf")})
+	intermediate := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: []byte("intermediate")})
+	input := fmt.Sprintf(`apiVersion: v1
+kind: Secret
+metadata:
+  name: tls
+type: kubernetes.io/tls
+data:
+  tls.crt: %s
+  tls.key: a2V5
+`, base64.StdEncoding.EncodeToString(append(leaf, intermediate...)))
+
+	files := build(t, input, WithSplitTLSChain(true))
+	if got := files["tls.crt"]; got != string(leaf) {
+		t.Errorf("tls.crt = %q, want the leaf %q", got, leaf)
+	}
+	if got := files["ca.crt"]; got != string(intermediate) {
+		t.Errorf("ca.crt = %q, want the intermediate %q", got, intermediate)
+	}
+	checkContains(t, files, "kustomization.yaml", "  - ca.crt\n  - tls.crt\n  - tls.key\n")
+
+	files = build(t, input)
+	if got := files["tls.crt"]; got != string(leaf)+string(intermediate) {
+		t.Errorf("tls.crt = %q, want the whole chain by default", got)
+	}
+	if _, ok := files["ca.crt"]; ok {
+		t.Error("ca.crt written by default")
+	}
+}
+
+func TestNumericallySuffixedFilenames(t *testing.T) {
+	var docs []string
+	for i := 1; i <= 20; i++ {
+		docs = append(docs, fmt.Sprintf("apiVersion: v1\nkind: Service\nmetadata:\n  name: web-%d\n", i))
+	}
+	files := build(t, strings.Join(docs, "---\n"))
+	if len(files) != 21 {
+		t.Errorf("wrote %d files, want 21", len(files))
+	}
+	for i := 1; i <= 20; i++ {
+		name := fmt.Sprintf("web-%d", i)
+		checkContains(t, files, name+".yaml", "name: "+name)
+		checkContains(t, files, "kustomization.yaml", "- "+name+".yaml\n")
+	}
+}
+
+func TestSortGeneratorFiles(t *testing.T) {
+	const input = `apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: app
+data:
+  a: a long enough value to be written as a file, not as a literal
+  b: a long enough value to be written as a file, not as a literal
+`
+	rename := WithGeneratorKeyRename(func(name, key string) string {
+		return map[string]string{"a": "z.txt", "b": "y.txt"}[key]
+	})
+	for _, tc := range []struct {
+		name  string
+		order GeneratorFilesOrder
+		want  string
+	}{
+		{name: "key", order: GeneratorFilesByKey, want: "  files:\n  - a=z.txt\n  - b=y.txt\n"},
+		{name: "filename", order: GeneratorFilesByFilename, want: "  files:\n  - b=y.txt\n  - a=z.txt\n"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			files := build(t, input, rename, WithSortGeneratorFiles(tc.order))
+			checkContains(t, files, "kustomization.yaml", tc.want)
+		})
+	}
+}
+
+func TestKustomizationName(t *testing.T) {
+	files := build(t, testWebAndAPI, WithKustomizationName(func(dir string) string {
+		if dir == "" {
+			return ""
+		}
+		return "app-" + dir
+	}))
+	checkContains(t, files, "web/kustomization.yaml", "kind: Kustomization\nmetadata:\n  name: app-web\n")
+	checkContains(t, files, "api/kustomization.yaml", "kind: Kustomization\nmetadata:\n  name: app-api\n")
+	if got := files["kustomization.yaml"]; strings.Contains(got, "metadata:") {
+		t.Errorf("kustomization.yaml = %q, want no metadata for an empty name", got)
+	}
+}
+
+const testLabeledGenerators = `apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: a
+  labels:
+    team: x
+    tier: a
+data:
+  key: a long enough value to be written as a file, not as a literal
+---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: b
+  labels:
+    team: x
+data:
+  key: a long enough value to be written as a file, not as a literal
+---
+apiVersion: v1
+kind: Secret
+metadata:
+  name: c
+  labels:
+    team: x
+data:
+  key: aGVsbG8=
+`
+
+func TestHoistGeneratorOptions(t *testing.T) {
+	files := build(t, testLabeledGenerators)
+	checkContains(t, files, "kustomization.yaml",
+		"generatorOptions:\n  disableNameSuffixHash: true\n  labels:\n    \"team\": \"x\"\n",
+		"- name: a\n  options:\n    labels:\n      \"tier\": \"a\"\n  files:\n",
+		"- name: b\n  files:\n",
+		"- name: c\n  files:\n",
+	)
+
+	files = build(t, testLabeledGenerators, WithHoistGeneratorOptions(false))
+	got := files["kustomization.yaml"]
+	if strings.Contains(got, "generatorOptions:") {
+		t.Errorf("kustomization.yaml = %q, want no generatorOptions", got)
+	}
+	checkContains(t, files, "kustomization.yaml",
+		"- name: b\n  options:\n    disableNameSuffixHash: true\n    labels:\n      \"team\": \"x\"\n",
+		"- name: c\n  options:\n    disableNameSuffixHash: true\n    labels:\n      \"team\": \"x\"\n",
+	)
+}
+
+func TestSortOptions(t *testing.T) {
+	files := build(t, testWebAndAPI, WithSortOptions("fifo"))
+	checkContains(t, files, "kustomization.yaml", "\nsortOptions:\n  order: fifo\n")
+	if got := files["web/kustomization.yaml"]; strings.Contains(got, "sortOptions:") {
+		t.Errorf("web/kustomization.yaml = %q, want sortOptions only at the top", got)
+	}
+
+	files = build(t, testWebAndAPI, WithSortOptions("fifo"), WithNamespacedOverlay("prod", ""))
+	checkContains(t, files, "overlay/kustomization.yaml", "\nsortOptions:\n  order: fifo\n")
+	if got := files["base/kustomization.yaml"]; strings.Contains(got, "sortOptions:") {
+		t.Errorf("base/kustomization.yaml = %q, want sortOptions only in the overlay", got)
+	}
+
+	files = build(t, testWebAndAPI)
+	if got := files["kustomization.yaml"]; strings.Contains(got, "sortOptions:") {
+		t.Errorf("kustomization.yaml = %q, want no sortOptions by default", got)
+	}
+
+	b := NewBuilder(WithSortOptions("random"))
+	if err := b.Build(NewMemFS().WriteFile); err == nil {
+		t.Error("Build with an unknown sort order succeeded, want an error")
+	}
+}
+
+const testSameNameConfigMaps = `apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: app
+data:
+  a: "1"
+---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: app
+data:
+  b: "2"
+`
+
+func TestDuplicateGeneratorNames(t *testing.T) {
+	b := NewBuilder(WithDuplicatePolicy(DuplicateKeepAll))
+	if err := b.Process(strings.NewReader(testSameNameConfigMaps)); err != nil {
+		t.Fatal(err)
+	}
+	err := b.Build(NewMemFS().WriteFile)
+	if err == nil || !strings.Contains(err.Error(), `duplicate configMapGenerator name "app"`) {
+		t.Errorf("Build = %v, want a duplicate generator name error", err)
+	}
+}
+
+const testPlainConfigMap = `apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: app
+data:
+  a: "1"
+`
+
+func TestMinimalGenerators(t *testing.T) {
+	files := build(t, testPlainConfigMap, WithMinimalGenerators(true))
+	if got := files["kustomization.yaml"]; strings.Contains(got, "options:") {
+		t.Errorf("kustomization.yaml = %q, want no options block", got)
+	}
+	checkContains(t, files, "kustomization.yaml", "- name: app\n  literals:\n  - a=1\n")
+
+	files = build(t, testPlainConfigMap)
+	checkContains(t, files, "kustomization.yaml", "  options:\n    disableNameSuffixHash: true\n")
+}
+
+func TestFluxKustomization(t *testing.T) {
+	files := build(t, testService, WithFluxKustomization("apps", "flux-system", "GitRepository/infra"))
+	want := `apiVersion: kustomize.toolkit.fluxcd.io/v1
+kind: Kustomization
+metadata:
+  name: apps
+  namespace: flux-system
+spec:
+  interval: 10m
+  path: ./
+  prune: true
+  sourceRef:
+    kind: GitRepository
+    name: infra
+`
+	if got := files["flux-kustomization.yaml"]; got != want {
+		t.Errorf("flux-kustomization.yaml = %q, want %q", got, want)
+	}
+	if got := files["kustomization.yaml"]; strings.Contains(got, "flux-kustomization.yaml") {
+		t.Errorf("kustomization.yaml = %q, want the Flux Kustomization left out of the resources", got)
+	}
+
+	files = build(t, testService, WithFluxKustomization("apps", "", "infra"))
+	checkContains(t, files, "flux-kustomization.yaml", "metadata:\n  name: apps\nspec:\n", "kind: GitRepository\n    name: infra\n")
+
+	b := NewBuilder(WithFluxKustomization("apps", "", ""))
+	if err := b.Build(NewMemFS().WriteFile); err == nil {
+		t.Error("Build without a sourceRef succeeded, want an error")
+	}
+}
+
+const testNamespacedServiceAndConfigMap = `apiVersion: v1
+kind: Service
+metadata:
+  name: web
+  namespace: prod
+---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: app
+  namespace: prod
+data:
+  a: "1"
+`
+
+func TestHoistNamespace(t *testing.T) {
+	files := build(t, testNamespacedServiceAndConfigMap)
+	checkContains(t, files, "kustomization.yaml", "kind: Kustomization\n\nnamespace: prod\n", "- name: app\n  options:")
+
+	files = build(t, testNamespacedServices, WithFilenameSuffixDisambiguation(true))
+	if got := files["kustomization.yaml"]; strings.Contains(got, "namespace:") {
+		t.Errorf("kustomization.yaml = %q, want no namespace for mixed namespaces", got)
+	}
+}
+
+const testTextAndBinaryConfigMap = `apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: app
+  namespace: prod
+data:
+  app.conf: |
+    listen 80
+    server_name example.com
+    root /var/www/html
+    index index.html
+binaryData:
+  logo.png: iVBORw0KGgo=
+`
+
+func TestGeneratorProvenanceComment(t *testing.T) {
+	files := build(t, testTextAndBinaryConfigMap, WithGeneratorProvenanceComment(true))
+	if got, want := files["app.conf"], "# from configmap prod/app key app.conf\nlisten 80\n"; !strings.HasPrefix(got, want) {
+		t.Errorf("app.conf = %q, want it to start with %q", got, want)
+	}
+	if got, want := files["logo.png"], "\x89PNG\r\n\x1a\n"; got != want {
+		t.Errorf("logo.png = %q, want %q", got, want)
+	}
+
+	files = build(t, testTextAndBinaryConfigMap)
+	if got := files["app.conf"]; !strings.HasPrefix(got, "listen 80\n") {
+		t.Errorf("app.conf = %q, want no comment by default", got)
+	}
+}
+
+const testDefaultAndEmptyNamespaces = `apiVersion: v1
+kind: Service
+metadata:
+  name: web
+---
+apiVersion: v1
+kind: ServiceAccount
+metadata:
+  name: web
+  namespace: default
+`
+
+func TestCanonicalNamespace(t *testing.T) {
+	files := build(t, testDefaultAndEmptyNamespaces, WithCanonicalNamespace(true))
+	checkContains(t, files, "kustomization.yaml", "\nnamespace: default\n")
+
+	files = build(t, testDefaultAndEmptyNamespaces)
+	if got := files["kustomization.yaml"]; strings.Contains(got, "namespace:") {
+		t.Errorf("kustomization.yaml = %q, want no namespace by default", got)
+	}
+}
+
+func TestLineEnding(t *testing.T) {
+	files := build(t, testTextAndBinaryConfigMap+"---\n"+testService, WithLineEnding("crlf"))
+	for _, name := range []string{"kustomization.yaml", "service.yaml", "app.conf"} {
+		data := files[name]
+		if !strings.Contains(data, "\r\n") || strings.Contains(strings.ReplaceAll(data, "\r\n", ""), "\n") {
+			t.Errorf("%s = %q, want CRLF line endings only", name, data)
+		}
+	}
+	if got, want := files["logo.png"], "\x89PNG\r\n\x1a\n"; got != want {
+		t.Errorf("logo.png = %q, want it untouched %q", got, want)
+	}
+
+	files = build(t, testTextAndBinaryConfigMap+"---\n"+testService)
+	for _, name := range []string{"kustomization.yaml", "service.yaml", "app.conf"} {
+		if data := files[name]; strings.Contains(data, "\r") {
+			t.Errorf("%s = %q, want LF line endings by default", name, data)
+		}
+	}
+}
+
+const testMixedLengthConfigMap = `apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: app
+data:
+  short: abc
+  long: a value that is longer than ten characters
+  multi: |
+    a
+    b
+binaryData:
+  bin: AAE=
+`
+
+func TestLiteralThreshold(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		opts     []Option
+		literals string
+		files    string
+	}{
+		{
+			name:     "default",
+			literals: "  literals:\n  - long=a value that is longer than ten characters\n  - short=abc\n",
+			files:    "  files:\n  - bin\n  - multi\n",
+		},
+		{
+			name:     "lowered",
+			opts:     []Option{WithLiteralThreshold(10)},
+			literals: "  literals:\n  - short=abc\n",
+			files:    "  files:\n  - bin\n  - long\n  - multi\n",
+		},
+		{
+			name:  "disabled",
+			opts:  []Option{WithLiteralThreshold(0)},
+			files: "  files:\n  - bin\n  - long\n  - multi\n  - short\n",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			files := build(t, testMixedLengthConfigMap, tc.opts...)
+			got := files["kustomization.yaml"]
+			if tc.literals == "" && strings.Contains(got, "literals:") {
+				t.Errorf("kustomization.yaml = %q, want no literals", got)
+			}
+			checkContains(t, files, "kustomization.yaml", tc.literals, tc.files)
+		})
+	}
+}
+
+func TestExplicitRelativePaths(t *testing.T) {
+	input := testWebAndAPI + "---\napiVersion: v1\nkind: Service\nmetadata:\n  name: root\n"
+	files := build(t, input, WithExplicitRelativePaths(true))
+	checkContains(t, files, "kustomization.yaml", "resources:\n- ./api\n- ./web\n- ./service.yaml\n")
+	checkContains(t, files, "web/kustomization.yaml", "resources:\n- ./deployment.yaml\n- ./service.yaml\n- ./serviceaccount.yaml\n")
+
+	files = build(t, input)
+	checkContains(t, files, "kustomization.yaml", "resources:\n- api\n- web\n- service.yaml\n")
+}
+
+const testEnvConfigMap = `apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: settings
+  annotations:
+    kustomizily.io/as-env: "true"
+data:
+  LOG_LEVEL: debug
+  DATABASE_URL: postgres://db.example.com:5432/app?sslmode=require&connect_timeout=10
+`
+
+func TestEnvConfigMap(t *testing.T) {
+	files := build(t, testEnvConfigMap)
+	checkContains(t, files, "kustomization.yaml", "- name: settings\n  options:\n    disableNameSuffixHash: true\n  envs:\n  - settings.env\n")
+	if got := files["kustomization.yaml"]; strings.Contains(got, "as-env") || strings.Contains(got, "literals:") {
+		t.Errorf("kustomization.yaml = %q, want only the env file", got)
+	}
+	checkContains(t, files, "settings.env", "DATABASE_URL=postgres://db.example.com:5432/app?sslmode=require&connect_timeout=10\nLOG_LEVEL=debug")
+}
+
+func TestRemoteBase(t *testing.T) {
+	files := build(t, testService, WithRemoteBase("https://github.com/org/repo//base?ref=v1"))
+	checkContains(t, files, "kustomization.yaml", "resources:\n- https://github.com/org/repo//base?ref=v1\n- service.yaml\n")
+
+	files = build(t, testWebAndAPI, WithRemoteBase("github.com/org/repo//base?ref=v1"))
+	checkContains(t, files, "kustomization.yaml", "- github.com/org/repo//base?ref=v1\n")
+	if got := files["web/kustomization.yaml"]; strings.Contains(got, "github.com") {
+		t.Errorf("web/kustomization.yaml = %q, want the remote base only in the root", got)
+	}
+
+	for _, base := range []string{"base", "../base", "github.com/org/repo //base"} {
+		b := NewBuilder(WithRemoteBase(base))
+		if err := b.Build(NewMemFS().WriteFile); err == nil {
+			t.Errorf("Build with remote base %q succeeded, want an error", base)
+		}
+	}
+}
+
+const testManyKeysConfigMap = `apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: app
+  labels:
+    tier: a
+    team: x
+    zone: z
+  annotations:
+    owner: ops
+    note: n
+    url: u
+data:
+  e.conf: |
+    e=1
+    e=2
+  d.conf: |
+    d=1
+    d=2
+  c.conf: |
+    c=1
+    c=2
+  b.conf: |
+    b=1
+    b=2
+  a.conf: |
+    a=1
+    a=2
+`
+
+func TestBuildDeterministic(t *testing.T) {
+	want := build(t, testManyKeysConfigMap)
+	checkContains(t, want, "kustomization.yaml",
+		"    annotations:\n      \"note\": \"n\"\n      \"owner\": \"ops\"\n      \"url\": \"u\"\n",
+		"    labels:\n      \"team\": \"x\"\n      \"tier\": \"a\"\n      \"zone\": \"z\"\n",
+		"  files:\n  - a.conf\n  - b.conf\n  - c.conf\n  - d.conf\n  - e.conf\n",
+	)
+	for range 10 {
+		if got := build(t, testManyKeysConfigMap); !maps.Equal(got, want) {
+			t.Fatalf("second build wrote %q, want it byte-identical to %q", got["kustomization.yaml"], want["kustomization.yaml"])
+		}
+	}
+}
+
+func TestForbidPlaintextSecrets(t *testing.T) {
+	b := NewBuilder(WithForbidPlaintextSecrets(true))
+	if err := b.Process(strings.NewReader(testConfigMapAndSecret)); err != nil {
+		t.Fatal(err)
+	}
+	err := b.Build(NewMemFS().WriteFile)
+	if err == nil || !strings.Contains(err.Error(), "secret creds would be written in plaintext") {
+		t.Errorf("Build = %v, want a plaintext secret error", err)
+	}
+
+	build(t, testConfigMapAndSecret)
+	build(t, testSealedSecret, WithForbidPlaintextSecrets(true))
+	build(t, "apiVersion: v1\nkind: Secret\nmetadata:\n  name: empty\n", WithForbidPlaintextSecrets(true))
+}
+
+func TestTreeGraph(t *testing.T) {
+	files := build(t, testWebAndAPI+"---\n"+testConfigMapAndSecret, WithTreeGraph(true))
+	checkContains(t, files, "structure.dot",
+		"digraph structure {\n",
+		"\n  \".\" [shape=folder, label=\".\"];\n",
+		"\n  \"web\" [shape=folder, label=\"web\"];\n",
+		"\n  \".\" -> \"web\";\n",
+		"\n  \".\" -> \"api\";\n",
+		"\n  \"web/deployment.yaml\" [shape=note, label=\"deployment.yaml\"];\n",
+		"\n  \"web\" -> \"web/deployment.yaml\";\n",
+		"\n  \"api\" -> \"api/service.yaml\";\n",
+		"\n  \".\" -> \"app.conf\";\n",
+		"\n}\n",
+	)
+	if got := files["kustomization.yaml"]; strings.Contains(got, "structure.dot") {
+		t.Errorf("kustomization.yaml = %q, want structure.dot left out", got)
+	}
+
+	files = build(t, testWebAndAPI)
+	if _, ok := files["structure.dot"]; ok {
+		t.Error("structure.dot written by default")
+	}
+}
+
+const testHelmLabeledConfigMap = `apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: app
+  labels:
+    managed-by: helm
+    tier: web
+data:
+  a: "1"
+---
+apiVersion: v1
+kind: Service
+metadata:
+  name: web
+`
+
+func TestGeneratorLabels(t *testing.T) {
+	files := build(t, testHelmLabeledConfigMap, WithGeneratorLabels(map[string]string{"managed-by": "kustomizily", "team": "x"}))
+	checkContains(t, files, "kustomization.yaml", "    labels:\n      \"managed-by\": \"helm\"\n      \"team\": \"x\"\n      \"tier\": \"web\"\n")
+	if got := files["service.yaml"]; strings.Contains(got, "team") {
+		t.Errorf("service.yaml = %q, want the generator labels only on generators", got)
+	}
+}
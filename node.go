@@ -0,0 +1,153 @@
+package kustomizily
+
+import (
+	"bytes"
+	"slices"
+
+	"gopkg.in/yaml.v3"
+)
+
+// toBlockYAML re-serializes a JSON or flow-style YAML document as block-style
+// YAML so that mixed YAML/JSON streams produce uniform output files.
+func toBlockYAML(data []byte) ([]byte, error) {
+	var node yaml.Node
+	if err := yaml.Unmarshal(data, &node); err != nil {
+		return nil, err
+	}
+	resetNodeStyle(&node)
+	return encodeYAMLNode(&node)
+}
+
+func resetNodeStyle(node *yaml.Node) {
+	node.Style = 0
+	for _, child := range node.Content {
+		resetNodeStyle(child)
+	}
+}
+
+func encodeYAMLNode(node *yaml.Node) ([]byte, error) {
+	data, err := marshalYAML(node)
+	if err != nil {
+		return nil, err
+	}
+	return bytes.TrimSpace(data), nil
+}
+
+// marshalYAML is like yaml.Marshal but indents with two spaces.
+func marshalYAML(v any) ([]byte, error) {
+	var buf bytes.Buffer
+	enc := yaml.NewEncoder(&buf)
+	enc.SetIndent(2)
+	if err := enc.Encode(v); err != nil {
+		return nil, err
+	}
+	if err := enc.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// editYAML applies edit to the top-level mapping of a document, keeping
+// the original key order and comments, and re-serializes it. The document
+// is returned untouched, formatting included, when edit reports no change.
+func editYAML(data []byte, edit func(node *yaml.Node) bool) ([]byte, error) {
+	var doc yaml.Node
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return nil, err
+	}
+	if doc.Kind != yaml.DocumentNode || len(doc.Content) == 0 {
+		return data, nil
+	}
+	if !edit(doc.Content[0]) {
+		return data, nil
+	}
+	return encodeYAMLNode(&doc)
+}
+
+// lookupMappingKey returns the value of key in a mapping node, or nil.
+func lookupMappingKey(node *yaml.Node, key string) *yaml.Node {
+	if node == nil || node.Kind != yaml.MappingNode {
+		return nil
+	}
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		if node.Content[i].Value == key {
+			return node.Content[i+1]
+		}
+	}
+	return nil
+}
+
+// deleteMappingKey removes key from a mapping node and reports whether it was present.
+func deleteMappingKey(node *yaml.Node, key string) bool {
+	if node == nil || node.Kind != yaml.MappingNode {
+		return false
+	}
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		if node.Content[i].Value == key {
+			node.Content = append(node.Content[:i], node.Content[i+2:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// ensureMappingKey returns the mapping value of key in a mapping node,
+// adding an empty one when key is missing or null.
+func ensureMappingKey(node *yaml.Node, key string) *yaml.Node {
+	value := lookupMappingKey(node, key)
+	if value != nil && value.Kind == yaml.MappingNode {
+		return value
+	}
+	mapping := &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map"}
+	if value != nil {
+		*value = *mapping
+		return value
+	}
+	node.Content = append(node.Content,
+		&yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: key},
+		mapping,
+	)
+	return mapping
+}
+
+// setMappingKey sets key to a string value in a mapping node.
+func setMappingKey(node *yaml.Node, key, value string) {
+	scalar := &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: value}
+	if existing := lookupMappingKey(node, key); existing != nil {
+		*existing = *scalar
+		return
+	}
+	node.Content = append(node.Content,
+		&yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: key},
+		scalar,
+	)
+}
+
+// reorderMappingKeys moves the given keys of a mapping node to its start
+// and end, in the given order, keeping the order of the other keys and the
+// comments attached to the moved ones. It reports whether the order changed.
+func reorderMappingKeys(node *yaml.Node, leading, trailing []string) bool {
+	if node == nil || node.Kind != yaml.MappingNode {
+		return false
+	}
+	take := func(key string) []*yaml.Node {
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			if node.Content[i].Value == key {
+				pair := node.Content[i : i+2 : i+2]
+				node.Content = append(node.Content[:i:i], node.Content[i+2:]...)
+				return pair
+			}
+		}
+		return nil
+	}
+	before := slices.Clone(node.Content)
+	var head, tail []*yaml.Node
+	for _, key := range leading {
+		head = append(head, take(key)...)
+	}
+	for _, key := range trailing {
+		tail = append(tail, take(key)...)
+	}
+	node.Content = slices.Concat(head, node.Content, tail)
+	return !slices.Equal(before, node.Content)
+}
@@ -0,0 +1,887 @@
+package kustomizily
+
+import (
+	"fmt"
+	"io/fs"
+	"log"
+	"path"
+	"slices"
+	"strings"
+	"text/template"
+)
+
+// Option configures optional behavior of a Builder.
+type Option func(*options)
+
+type options struct {
+	generatorFilesSubdir   string
+	generatorKeyRename     func(name, key string) string
+	resolveReferences      bool
+	baseDir                string
+	keepEmptyDirs          bool
+	logger                 *log.Logger
+	autoLayoutThreshold    int
+	duplicatePolicy        DuplicatePolicy
+	stripManagedFields     bool
+	configDir              string
+	decodeSecretsToText    bool
+	annotatedKustomization bool
+	clusterScopedDir       string
+	resourceListFile       bool
+	lenientFieldNames      bool
+	gitAttributes          bool
+	collapseSingletonDirs  bool
+
+	filenameSuffixDisambiguation bool
+	filenameDiagnostics          bool
+
+	namespacedOverlay *namespacedOverlay
+	preserveInputDirs bool
+	imagePullSecret   string
+	sectionOrder      []string
+	splitTLSChain     bool
+
+	generatorFilesOrder GeneratorFilesOrder
+	kustomizationName   func(dir string) string
+
+	hoistGeneratorOptions bool
+	noHoistAnnotations    []string
+	hoistCommonLabels     bool
+	labelHoistStrip       bool
+
+	sortOrder    string
+	groupByChart bool
+
+	minimalGenerators bool
+	fluxKustomization *fluxKustomization
+
+	groupNetworking bool
+	networkingKinds []string
+	routingLabels   []string
+
+	groupBatch bool
+	batchKinds []string
+
+	treatAsGenerator []string
+
+	literalThreshold int
+
+	explicitRelativePaths bool
+
+	remoteBase string
+
+	forbidPlaintextSecrets bool
+
+	contentDedupDir string
+
+	treeGraph bool
+
+	canonicalKeyOrder bool
+
+	generatorLabels map[string]string
+
+	generatorProvenanceComment bool
+	sharedBase                 string
+	canonicalNamespace         bool
+	flatLayout                 bool
+	recursiveConfigMapSplit    bool
+	hoistNamePrefix            bool
+	lineEnding                 string
+	layoutStrategy             LayoutStrategy
+	generatedAnnotation        bool
+	timestamp                  bool
+
+	envSubst       bool
+	envSubstMap    map[string]string
+	envSubstStrict bool
+
+	kustomizationPostProcess func(dir string, data []byte) ([]byte, error)
+
+	previousOutput fs.FS
+	skippedFile    func(dir string, name string)
+
+	kindFilenameTemplateTexts map[string]string
+	kindFilenameTemplates     map[string]*template.Template
+}
+
+func defaultOptions() options {
+	return options{
+		logger:             log.Default(),
+		stripManagedFields: true,
+		duplicatePolicy:    DuplicateError,
+		routingLabels:      defaultRoutingLabels,
+		literalThreshold:   60,
+
+		hoistGeneratorOptions: true,
+		noHoistAnnotations:    defaultNoHoistAnnotations,
+		hoistCommonLabels:     true,
+	}
+}
+
+// WithLogger sets the logger used to report warnings. Defaults to log.Default().
+func WithLogger(logger *log.Logger) Option {
+	return func(o *options) {
+		o.logger = logger
+	}
+}
+
+// WithGeneratorFilesSubdir places all configMap/secret generator file payloads
+// under the named subfolder within each directory, e.g. "_generated".
+func WithGeneratorFilesSubdir(subdir string) Option {
+	return func(o *options) {
+		o.generatorFilesSubdir = subdir
+	}
+}
+
+// WithGeneratorKeyRename renames the file written for a generator key. The function
+// receives the ConfigMap/Secret name and the data key and returns the new filename
+// base, or "" to keep the key. Only the file side changes: the generator references
+// it as key=filename, so the in-cluster data key stays the same. Build fails
+// on a filename that isn't local to the directory, such as "../x" or "a/b".
+func WithGeneratorKeyRename(rename func(name, key string) string) Option {
+	return func(o *options) {
+		o.generatorKeyRename = rename
+	}
+}
+
+// WithResolveReferences makes a Kustomization document in the input pull in the
+// files listed under its resources, flattening an existing kustomize base.
+func WithResolveReferences(resolve bool) Option {
+	return func(o *options) {
+		o.resolveReferences = resolve
+	}
+}
+
+// WithBaseDir sets the directory that references in the input are resolved against.
+func WithBaseDir(dir string) Option {
+	return func(o *options) {
+		o.baseDir = dir
+	}
+}
+
+// WithKeepEmptyDirs keeps directories that end up without any content, writing
+// an empty kustomization for them. By default they are dropped together with
+// their reference in the root kustomization.
+func WithKeepEmptyDirs(keep bool) Option {
+	return func(o *options) {
+		o.keepEmptyDirs = keep
+	}
+}
+
+// WithAutoLayout splits any grouped directory holding more than threshold
+// resources of mixed kinds into one subdirectory per kind, keeping smaller
+// directories flat. A threshold of 0 disables it.
+func WithAutoLayout(threshold int) Option {
+	return func(o *options) {
+		o.autoLayoutThreshold = threshold
+	}
+}
+
+// DuplicatePolicy controls how resources sharing the same apiVersion, kind,
+// namespace and name are handled, regardless of the directory they route to.
+type DuplicatePolicy int
+
+const (
+	// DuplicateKeepAll writes every copy of a duplicated resource.
+	DuplicateKeepAll DuplicatePolicy = iota
+	// DuplicateKeepFirst keeps the first copy and ignores later ones.
+	DuplicateKeepFirst
+	// DuplicateError fails processing when a duplicate is seen.
+	DuplicateError
+	// DuplicateKeepLast replaces earlier copies with the last one.
+	DuplicateKeepLast
+)
+
+// WithDuplicatePolicy sets how duplicated resources are handled.
+// Defaults to DuplicateError.
+func WithDuplicatePolicy(policy DuplicatePolicy) Option {
+	return func(o *options) {
+		o.duplicatePolicy = policy
+	}
+}
+
+// WithAllowDuplicates lets later copies of a duplicated resource replace
+// earlier ones, for inputs overlapping on purpose, instead of failing.
+func WithAllowDuplicates(allow bool) Option {
+	return func(o *options) {
+		if allow {
+			o.duplicatePolicy = DuplicateKeepLast
+		} else {
+			o.duplicatePolicy = DuplicateError
+		}
+	}
+}
+
+// WithStripManagedFields removes metadata.managedFields from written resources.
+// Defaults to true, as server-side apply bookkeeping is meaningless in kustomize.
+func WithStripManagedFields(strip bool) Option {
+	return func(o *options) {
+		o.stripManagedFields = strip
+	}
+}
+
+// WithKindFilenameTemplates names resources of the given kinds with their own
+// Go template instead of the default strategy cascade, e.g.
+// {"Deployment": "workload-{{.Name}}.yaml"}. Templates can use .Name,
+// .ShortName, .Namespace, .Kind and .APIVersion. Build fails on a rendered
+// filename that isn't local to the directory, such as "" or "../x".
+func WithKindFilenameTemplates(templates map[string]string) Option {
+	return func(o *options) {
+		o.kindFilenameTemplateTexts = templates
+	}
+}
+
+// WithConfigDir routes every ConfigMap and Secret into the named directory,
+// regardless of their labels. Generator names are preserved, so workloads
+// referencing them keep working.
+func WithConfigDir(dir string) Option {
+	return func(o *options) {
+		o.configDir = dir
+	}
+}
+
+// WithKustomizationPostProcess sets a callback that receives each assembled
+// kustomization.yaml with its directory just before it is written. The
+// returned bytes are written instead, e.g. to prepend a license header.
+func WithKustomizationPostProcess(postProcess func(dir string, data []byte) ([]byte, error)) Option {
+	return func(o *options) {
+		o.kustomizationPostProcess = postProcess
+	}
+}
+
+// WithSkipUnchangedDirs builds the output in memory first and writes only the
+// directories with a file whose content differs from previous, typically
+// os.DirFS of the output directory, so re-running over unchanged input writes
+// nothing. skipped, if not nil, is called for each file left out, e.g. FS.Keep.
+func WithSkipUnchangedDirs(previous fs.FS, skipped func(dir string, name string)) Option {
+	return func(o *options) {
+		o.previousOutput = previous
+		o.skippedFile = skipped
+	}
+}
+
+// WithDecodeSecretsToText writes every Secret value as a plaintext file. Values
+// that aren't UTF-8 text are kept base64-encoded in a file with a ".b64" suffix;
+// kustomize does not decode those, so such secrets no longer round-trip
+// losslessly and the files need decoding before building.
+func WithDecodeSecretsToText(decode bool) Option {
+	return func(o *options) {
+		o.decodeSecretsToText = decode
+	}
+}
+
+// WithAnnotatedKustomization emits an explanatory comment above each
+// section of the generated kustomization.yaml files.
+func WithAnnotatedKustomization(annotated bool) Option {
+	return func(o *options) {
+		o.annotatedKustomization = annotated
+	}
+}
+
+// WithClusterScopedDir routes custom resources whose CustomResourceDefinition
+// has Cluster scope into the named directory, while Namespaced custom resources
+// keep the label-based grouping. Only CRDs that appear in the input before
+// their custom resources are taken into account.
+func WithClusterScopedDir(dir string) Option {
+	return func(o *options) {
+		o.clusterScopedDir = dir
+	}
+}
+
+// WithResourceListFile writes a .resource-list.yaml in each directory indexing
+// its resources, generators and replacements with their apiVersion, kind, name
+// and the paths, SHA256 digests and sizes of their files. Resources moved by
+// WithContentDedup are listed with the shared kustomization holding them.
+func WithResourceListFile(resourceListFile bool) Option {
+	return func(o *options) {
+		o.resourceListFile = resourceListFile
+	}
+}
+
+// WithLenientFieldNames accepts case variants of the apiVersion, kind and
+// metadata fields, such as apiversion, instead of skipping the document.
+func WithLenientFieldNames(lenient bool) Option {
+	return func(o *options) {
+		o.lenientFieldNames = lenient
+	}
+}
+
+// WithGitAttributes writes a root .gitattributes marking the generated
+// files holding binary data as binary.
+func WithGitAttributes(gitAttributes bool) Option {
+	return func(o *options) {
+		o.gitAttributes = gitAttributes
+	}
+}
+
+// WithCollapseSingletonDirs moves the resource of any directory holding a
+// single resource and no generators back into its parent, prefixing its
+// filename with the directory name, and removes the directory.
+func WithCollapseSingletonDirs(collapse bool) Option {
+	return func(o *options) {
+		o.collapseSingletonDirs = collapse
+	}
+}
+
+// WithFilenameSuffixDisambiguation appends -2, -3, ... to colliding
+// name-and-kind filenames instead of escalating to the verbose filename
+// that includes the apiVersion.
+func WithFilenameSuffixDisambiguation(suffix bool) Option {
+	return func(o *options) {
+		o.filenameSuffixDisambiguation = suffix
+	}
+}
+
+// WithFilenameDiagnostics logs, per directory, which filename strategy was
+// selected for resources and generators and any prefix that was trimmed.
+func WithFilenameDiagnostics(diagnostics bool) Option {
+	return func(o *options) {
+		o.filenameDiagnostics = diagnostics
+	}
+}
+
+type namespacedOverlay struct {
+	namespace  string
+	namePrefix string
+}
+
+// WithNamespacedOverlay writes the split resources under base/ and generates
+// an overlay/ directory whose kustomization references ../base and sets the
+// namespace and namePrefix. Empty values are omitted.
+func WithNamespacedOverlay(namespace, namePrefix string) Option {
+	return func(o *options) {
+		o.namespacedOverlay = &namespacedOverlay{namespace: namespace, namePrefix: namePrefix}
+	}
+}
+
+// WithPreserveInputDirs routes the resources of each file processed by
+// ProcessDir into the directory of that file relative to the input root,
+// instead of grouping them by labels.
+func WithPreserveInputDirs(preserve bool) Option {
+	return func(o *options) {
+		o.preserveInputDirs = preserve
+	}
+}
+
+// WithImagePullSecret generates, in each directory, a strategic-merge patch
+// adding the named imagePullSecret to every ServiceAccount.
+func WithImagePullSecret(name string) Option {
+	return func(o *options) {
+		o.imagePullSecret = name
+	}
+}
+
+// WithSplitTLSChain splits the certificate chain in the tls.crt of
+// kubernetes.io/tls secrets into the leaf certificate in tls.crt and the
+// intermediates in ca.crt. Note this changes the data of the generated secret.
+func WithSplitTLSChain(split bool) Option {
+	return func(o *options) {
+		o.splitTLSChain = split
+	}
+}
+
+// GeneratorFilesOrder controls the order of the files of a generator.
+type GeneratorFilesOrder int
+
+const (
+	// GeneratorFilesByKey orders generator files by their data key.
+	GeneratorFilesByKey GeneratorFilesOrder = iota
+	// GeneratorFilesByFilename orders generator files by the referenced filename.
+	GeneratorFilesByFilename
+)
+
+// WithSortGeneratorFiles sets the order of the files list of generators.
+// Defaults to GeneratorFilesByKey. Only the emission order is affected.
+func WithSortGeneratorFiles(order GeneratorFilesOrder) Option {
+	return func(o *options) {
+		o.generatorFilesOrder = order
+	}
+}
+
+// WithKustomizationName emits metadata.name in each generated kustomization,
+// derived from its directory ("" for the root) by the given function.
+// An empty name omits the metadata block.
+func WithKustomizationName(name func(dir string) string) Option {
+	return func(o *options) {
+		o.kustomizationName = name
+	}
+}
+
+// WithHoistGeneratorOptions moves the options shared by all configMap and
+// secret generators of a directory, disableNameSuffixHash and the common
+// labels and annotations, into a top-level generatorOptions, keeping only the
+// differing ones per generator. Disable it to repeat the options on every
+// generator. Defaults to true.
+func WithHoistGeneratorOptions(hoist bool) Option {
+	return func(o *options) {
+		o.hoistGeneratorOptions = hoist
+	}
+}
+
+// defaultNoHoistAnnotations are annotations meaningful per resource, left
+// on each generator even when they are shared.
+var defaultNoHoistAnnotations = []string{
+	"kubectl.kubernetes.io/last-applied-configuration",
+	"prometheus.io/scrape",
+	"prometheus.io/port",
+	"prometheus.io/path",
+	"argocd.argoproj.io/sync-wave",
+	"argocd.argoproj.io/hook",
+	"helm.sh/hook",
+	"helm.sh/hook-weight",
+	"helm.sh/resource-policy",
+}
+
+// WithNoHoistAnnotations sets the annotations never moved into the
+// generatorOptions by WithHoistGeneratorOptions, even when all generators
+// share them. Defaults to per-resource annotations such as the Prometheus
+// scrape settings, Argo CD sync waves and Helm hooks.
+func WithNoHoistAnnotations(keys []string) Option {
+	return func(o *options) {
+		o.noHoistAnnotations = keys
+	}
+}
+
+// WithHoistCommonLabels adds the labels shared by all resources and
+// generators of a directory to the kustomization's labels. The labels don't
+// include selectors, so selectors and pod templates are left as they are.
+// The resources keep their own copy unless WithLabelHoistStrip is set.
+// Defaults to true.
+func WithHoistCommonLabels(hoist bool) Option {
+	return func(o *options) {
+		o.hoistCommonLabels = hoist
+	}
+}
+
+// WithLabelHoistStrip removes the labels hoisted by WithHoistCommonLabels
+// from the resources and generators, leaving the kustomization's labels as
+// their only source. Defaults to false, which adds the labels without
+// touching the resources.
+func WithLabelHoistStrip(strip bool) Option {
+	return func(o *options) {
+		o.labelHoistStrip = strip
+	}
+}
+
+// WithEnvSubst expands ${VAR} and $VAR references in each input document
+// from the process environment before parsing it.
+func WithEnvSubst(envSubst bool) Option {
+	return func(o *options) {
+		o.envSubst = envSubst
+	}
+}
+
+// WithEnvSubstMap expands ${VAR} and $VAR references in each input document
+// from vars instead of the process environment.
+func WithEnvSubstMap(vars map[string]string) Option {
+	return func(o *options) {
+		o.envSubst = true
+		o.envSubstMap = vars
+	}
+}
+
+// WithEnvSubstStrict makes references to undefined variables an error.
+// By default they are left intact.
+func WithEnvSubstStrict(strict bool) Option {
+	return func(o *options) {
+		o.envSubstStrict = strict
+	}
+}
+
+// WithGroupByChart routes resources carrying a helm.sh/chart label into a
+// directory named after the chart, with the version stripped. Resources
+// without the label fall back to the label-based grouping.
+func WithGroupByChart(groupByChart bool) Option {
+	return func(o *options) {
+		o.groupByChart = groupByChart
+	}
+}
+
+// WithMinimalGenerators keeps kustomize's default generator behavior,
+// including the name suffix hash, by leaving out disableNameSuffixHash.
+// The options of a generator are only written when it has labels,
+// annotations or is immutable.
+func WithMinimalGenerators(minimal bool) Option {
+	return func(o *options) {
+		o.minimalGenerators = minimal
+	}
+}
+
+type fluxKustomization struct {
+	name       string
+	namespace  string
+	sourceKind string
+	sourceName string
+}
+
+// WithFluxKustomization writes a root flux-kustomization.yaml holding a Flux
+// Kustomization that applies the generated output. The sourceRef is either
+// "<kind>/<name>" or a bare name referring to a GitRepository. The path is
+// relative to the output directory, which is expected to be the source root.
+func WithFluxKustomization(name, namespace, sourceRef string) Option {
+	return func(o *options) {
+		kind, sourceName, ok := strings.Cut(sourceRef, "/")
+		if !ok {
+			kind, sourceName = "GitRepository", sourceRef
+		}
+		o.fluxKustomization = &fluxKustomization{
+			name:       name,
+			namespace:  namespace,
+			sourceKind: kind,
+			sourceName: sourceName,
+		}
+	}
+}
+
+// WithGroupNetworking routes networking resources, such as Ingresses and
+// Gateway API routes, into a networking/ directory regardless of their labels.
+func WithGroupNetworking(groupNetworking bool) Option {
+	return func(o *options) {
+		o.groupNetworking = groupNetworking
+	}
+}
+
+// WithNetworkingKinds adds kinds to the ones routed by WithGroupNetworking.
+func WithNetworkingKinds(kinds []string) Option {
+	return func(o *options) {
+		o.networkingKinds = append(o.networkingKinds, kinds...)
+	}
+}
+
+// WithGroupBatch routes batch workloads, Jobs and CronJobs, into a batch/
+// directory regardless of their labels.
+func WithGroupBatch(groupBatch bool) Option {
+	return func(o *options) {
+		o.groupBatch = groupBatch
+	}
+}
+
+// WithBatchKinds adds kinds to the ones routed by WithGroupBatch.
+func WithBatchKinds(kinds []string) Option {
+	return func(o *options) {
+		o.batchKinds = append(o.batchKinds, kinds...)
+	}
+}
+
+// WithRoutingLabels sets the label keys, in order of priority, whose value
+// names the directory of a resource. Resources matching none of them go to
+// the root directory. Defaults to app.kubernetes.io/component, component,
+// app.kubernetes.io/name and app.
+func WithRoutingLabels(keys []string) Option {
+	return func(o *options) {
+		o.routingLabels = keys
+	}
+}
+
+// WithLiteralThreshold sets the length up to which single-line ConfigMap
+// values are written as configMapGenerator literals instead of files.
+// Binary data is always written to files. Defaults to 60; 0 disables literals.
+func WithLiteralThreshold(threshold int) Option {
+	return func(o *options) {
+		o.literalThreshold = threshold
+	}
+}
+
+// WithTreatAsGenerator places resources of the given kinds, such as SealedSecret
+// or ExternalSecret, like generated ConfigMaps and Secrets: they are routed into
+// the config dir and named after their resource name, as generator files are.
+// They are still written as plain resources. A filename template set for one
+// of the kinds takes precedence over the naming.
+func WithTreatAsGenerator(kinds []string) Option {
+	return func(o *options) {
+		o.treatAsGenerator = append(o.treatAsGenerator, kinds...)
+	}
+}
+
+// WithGeneratorProvenanceComment prepends a "# from configmap <namespace>/<name>
+// key <key>" comment to the text files extracted from ConfigMaps. Note the
+// comment becomes part of the generated ConfigMap's data.
+func WithGeneratorProvenanceComment(comment bool) Option {
+	return func(o *options) {
+		o.generatorProvenanceComment = comment
+	}
+}
+
+// WithSharedBase splits resources carrying an environment label between a
+// shared base written to baseDir and an overlay per environment written to
+// overlays/<environment>, which includes the shared base. Resources present
+// with the same content in all environments go to the shared base without
+// their environment label; the other ones are written as a whole into the
+// overlay of their environment. Resources without the label go to the
+// shared base unchanged.
+func WithSharedBase(baseDir string) Option {
+	return func(o *options) {
+		o.sharedBase = baseDir
+	}
+}
+
+// WithCanonicalNamespace treats resources without a namespace as being in the
+// "default" namespace when deciding whether all resources of a directory share
+// one, so a mix of both hoists "default" into the kustomization.
+func WithCanonicalNamespace(canonical bool) Option {
+	return func(o *options) {
+		o.canonicalNamespace = canonical
+	}
+}
+
+// WithFlatLayout writes all resources into the root directory, under a single
+// kustomization. ConfigMaps and Secrets are still turned into generators.
+func WithFlatLayout(flat bool) Option {
+	return func(o *options) {
+		o.flatLayout = flat
+	}
+}
+
+// WithRecursiveConfigMapSplit processes the ConfigMap values that hold
+// Kubernetes manifests like input documents, writing the manifests as
+// resources instead of keeping the value in the ConfigMap. Values holding
+// anything but resources with an apiVersion, kind and name are kept.
+func WithRecursiveConfigMapSplit(recursive bool) Option {
+	return func(o *options) {
+		o.recursiveConfigMapSplit = recursive
+	}
+}
+
+// WithHoistNamePrefix moves the prefix, up to a "-", shared by the names of
+// all resources and generators of a directory into the kustomization's
+// namePrefix, removing it from the names. Directories whose resources refer to
+// each other by name are left as they are.
+func WithHoistNamePrefix(hoist bool) Option {
+	return func(o *options) {
+		o.hoistNamePrefix = hoist
+	}
+}
+
+// WithLineEnding sets the line endings of the text files written, either
+// "lf" or "crlf". Binary files are left untouched. Note the line endings of
+// generator files become part of the generated data. Defaults to "lf".
+func WithLineEnding(lineEnding string) Option {
+	return func(o *options) {
+		o.lineEnding = lineEnding
+	}
+}
+
+// LayoutStrategy controls the directories resources are routed into.
+type LayoutStrategy int
+
+const (
+	// LayoutByLabel routes resources into directories named after their
+	// component or app labels.
+	LayoutByLabel LayoutStrategy = iota
+	// LayoutByNamespace routes namespaced resources into a directory per
+	// namespace, nesting the label-based directories within it.
+	LayoutByNamespace
+)
+
+// WithLayoutStrategy sets how resources are routed into directories.
+// Defaults to LayoutByLabel.
+func WithLayoutStrategy(strategy LayoutStrategy) Option {
+	return func(o *options) {
+		o.layoutStrategy = strategy
+	}
+}
+
+// WithGeneratedAnnotation stamps the written resources, generators aside,
+// with a kustomizily.io/generated: "true" annotation.
+func WithGeneratedAnnotation(generated bool) Option {
+	return func(o *options) {
+		o.generatedAnnotation = generated
+	}
+}
+
+// WithTimestamp adds a kustomizily.io/generated-at annotation holding the
+// time of processing to the resources stamped by WithGeneratedAnnotation.
+// The output then changes on every run.
+func WithTimestamp(timestamp bool) Option {
+	return func(o *options) {
+		o.timestamp = timestamp
+	}
+}
+
+// WithExplicitRelativePaths writes the resource, component and replacement
+// references of the kustomizations with an explicit ./ prefix, as some
+// linters require.
+func WithExplicitRelativePaths(explicit bool) Option {
+	return func(o *options) {
+		o.explicitRelativePaths = explicit
+	}
+}
+
+// WithRemoteBase adds a remote kustomize base, such as
+// github.com/org/repo//base?ref=v1, to the resources of the root
+// kustomization, so that the output is layered on a published base.
+func WithRemoteBase(url string) Option {
+	return func(o *options) {
+		o.remoteBase = url
+	}
+}
+
+// WithForbidPlaintextSecrets makes Build fail rather than write the data of
+// a Secret to disk, guarding against committing secrets to git. Encrypted
+// kinds, such as SealedSecrets, are not affected.
+func WithForbidPlaintextSecrets(forbid bool) Option {
+	return func(o *options) {
+		o.forbidPlaintextSecrets = forbid
+	}
+}
+
+// WithContentDedup writes resources found in several directories with the
+// same content, apart from their name and namespace, once into a
+// kustomization under sharedDir. Each of those directories references it
+// and patches in its own name and namespace. sharedDir is not referenced from
+// its parent, so building the root still yields every resource once.
+func WithContentDedup(sharedDir string) Option {
+	return func(o *options) {
+		o.contentDedupDir = sharedDir
+	}
+}
+
+// WithTreeGraph writes a structure.dot file at the root, a Graphviz graph of
+// the output directories and the files they contain, for documentation.
+func WithTreeGraph(treeGraph bool) Option {
+	return func(o *options) {
+		o.treeGraph = treeGraph
+	}
+}
+
+// WithCanonicalKeyOrder reorders the top-level keys of generic resources as
+// Kubernetes writes them: apiVersion, kind and metadata first, status last,
+// and the other keys in between in their original order. Nested keys and
+// comments are kept as they are.
+func WithCanonicalKeyOrder(canonical bool) Option {
+	return func(o *options) {
+		o.canonicalKeyOrder = canonical
+	}
+}
+
+// WithGeneratorLabels adds labels to every configMapGenerator and
+// secretGenerator. The labels of the ConfigMap or Secret win on conflict.
+func WithGeneratorLabels(labels map[string]string) Option {
+	return func(o *options) {
+		o.generatorLabels = labels
+	}
+}
+
+// defaultSectionOrder is the default order of the kustomization sections.
+var defaultSectionOrder = []string{
+	"labels",
+	"resources",
+	"components",
+	"generatorOptions",
+	"configMapGenerator",
+	"secretGenerator",
+	"patches",
+	"replacements",
+	"helmCharts",
+	"sortOptions",
+}
+
+// generatorFilenameTemplate names the resources treated as generators.
+var generatorFilenameTemplate = template.Must(template.New("generator").Parse("{{.Name}}.yaml"))
+
+// lineEndings are the line endings known to WithLineEnding.
+var lineEndings = []string{"lf", "crlf"}
+
+// sortOrders are the orders known to kustomize's sortOptions.
+var sortOrders = []string{"legacy", "fifo"}
+
+// WithSortOptions pins the order kustomize emits resources in by writing a
+// sortOptions block to the top-level kustomization. The order is either
+// "legacy" or "fifo". With "fifo" the resource files of each kustomization
+// are listed in input order rather than by filename.
+func WithSortOptions(order string) Option {
+	return func(o *options) {
+		o.sortOrder = order
+	}
+}
+
+// WithSectionOrder sets the order of the top-level kustomization sections.
+// Known sections left out keep their default relative order after the listed ones.
+func WithSectionOrder(order []string) Option {
+	return func(o *options) {
+		o.sectionOrder = order
+	}
+}
+
+// sections returns the kustomization sections in the order they're written.
+func (o *options) sections() []string {
+	sections := slices.Clone(o.sectionOrder)
+	for _, section := range defaultSectionOrder {
+		if !slices.Contains(sections, section) {
+			sections = append(sections, section)
+		}
+	}
+	return sections
+}
+
+func (o *options) validate() error {
+	if subdir := o.generatorFilesSubdir; subdir != "" && !isValidRelativePath(subdir) {
+		return fmt.Errorf("invalid generator files subdir %q: must be a clean relative path", subdir)
+	}
+	if dir := o.configDir; dir != "" && !isValidRelativePath(dir) {
+		return fmt.Errorf("invalid config dir %q: must be a clean relative path", dir)
+	}
+	if dir := o.clusterScopedDir; dir != "" && !isValidRelativePath(dir) {
+		return fmt.Errorf("invalid cluster scoped dir %q: must be a clean relative path", dir)
+	}
+	if dir := o.contentDedupDir; dir != "" && !isValidRelativePath(dir) {
+		return fmt.Errorf("invalid content dedup dir %q: must be a clean relative path", dir)
+	}
+
+	if le := o.lineEnding; le != "" && !slices.Contains(lineEndings, le) {
+		return fmt.Errorf("invalid line ending %q: must be one of %s", le, strings.Join(lineEndings, ", "))
+	}
+	if order := o.sortOrder; order != "" && !slices.Contains(sortOrders, order) {
+		return fmt.Errorf("invalid sort order %q: must be one of %s", order, strings.Join(sortOrders, ", "))
+	}
+
+	if base := o.remoteBase; base != "" && (!isRemoteResource(base) || strings.ContainsAny(base, " \t\r\n")) {
+		return fmt.Errorf("invalid remote base %q: must be a kustomize remote target", base)
+	}
+
+	if flux := o.fluxKustomization; flux != nil && (flux.name == "" || flux.sourceKind == "" || flux.sourceName == "") {
+		return fmt.Errorf("invalid Flux Kustomization: name and sourceRef are required")
+	}
+
+	if dir := o.sharedBase; dir != "" {
+		if !isValidRelativePath(dir) {
+			return fmt.Errorf("invalid shared base dir %q: must be a clean relative path", dir)
+		}
+		if dir == overlaysDir || strings.HasPrefix(dir, overlaysDir+"/") {
+			return fmt.Errorf("invalid shared base dir %q: conflicts with the %s dir", dir, overlaysDir)
+		}
+		if o.namespacedOverlay != nil {
+			return fmt.Errorf("shared base can't be combined with a namespaced overlay")
+		}
+	}
+
+	seen := map[string]struct{}{}
+	for _, section := range o.sectionOrder {
+		if !slices.Contains(defaultSectionOrder, section) {
+			return fmt.Errorf("unknown kustomization section %q", section)
+		}
+		if _, ok := seen[section]; ok {
+			return fmt.Errorf("duplicate kustomization section %q", section)
+		}
+		seen[section] = struct{}{}
+	}
+
+	o.kindFilenameTemplates = map[string]*template.Template{}
+	for kind, text := range o.kindFilenameTemplateTexts {
+		tmpl, err := template.New(kind).Option("missingkey=error").Parse(text)
+		if err != nil {
+			return fmt.Errorf("invalid filename template for kind %s: %w", kind, err)
+		}
+		o.kindFilenameTemplates[kind] = tmpl
+	}
+	for _, kind := range o.treatAsGenerator {
+		if _, ok := o.kindFilenameTemplates[kind]; !ok {
+			o.kindFilenameTemplates[kind] = generatorFilenameTemplate
+		}
+	}
+	return nil
+}
+
+func isValidRelativePath(p string) bool {
+	return !path.IsAbs(p) && path.Clean(p) == p && p != "." && p != ".." && !strings.HasPrefix(p, "../")
+}
@@ -33,7 +33,7 @@ func splitYAMLDocument(data []byte, atEOF bool) (advance int, token []byte, err
 		return 0, nil, nil
 	}
 	sep := len([]byte(yamlSeparator))
-	if i := bytes.Index(data, []byte(yamlSeparator)); i >= 0 {
+	if i := indexYAMLSeparator(data); i >= 0 {
 		// We have a potential document terminator
 		i += sep
 		after := data[i:]
@@ -47,6 +47,11 @@ func splitYAMLDocument(data []byte, atEOF bool) (advance int, token []byte, err
 		if j := bytes.IndexByte(after, '\n'); j >= 0 {
 			return i + j + 1, data[0 : i-sep], nil
 		}
+		// The separator line is the last line of the stream, don't drop
+		// the document before it.
+		if atEOF {
+			return len(data), data[0 : i-sep], nil
+		}
 		return 0, nil, nil
 	}
 	// If we're at EOF, we have a final, non-terminated line. Return it.
@@ -56,3 +61,27 @@ func splitYAMLDocument(data []byte, atEOF bool) (advance int, token []byte, err
 	// Request more data.
 	return 0, nil, nil
 }
+
+// indexYAMLSeparator returns the index of the first document separator in data,
+// or -1. Like YAML parsers, only a "---" at column zero followed by a blank or
+// the end of the line counts: an indented "---", which is content of a block
+// scalar, or a line such as "----" doesn't.
+func indexYAMLSeparator(data []byte) int {
+	offset := 0
+	for {
+		i := bytes.Index(data[offset:], []byte(yamlSeparator))
+		if i < 0 {
+			return -1
+		}
+		i += offset
+		end := i + len(yamlSeparator)
+		if end == len(data) {
+			return i
+		}
+		switch data[end] {
+		case ' ', '\t', '\r', '\n':
+			return i
+		}
+		offset = end
+	}
+}
@@ -0,0 +1,154 @@
+package kustomizily
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// scanDocuments returns the non-blank documents of input, trimmed as
+// Builder.process trims them.
+func scanDocuments(t *testing.T, input string) []string {
+	t.Helper()
+	scanner := newScanner(strings.NewReader(input))
+	docs := []string{}
+	for scanner.Scan() {
+		if doc := bytes.TrimSpace(scanner.Bytes()); len(doc) > 0 {
+			docs = append(docs, string(doc))
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		t.Fatal(err)
+	}
+	return docs
+}
+
+const (
+	testDocA = "apiVersion: v1\nkind: Service\nmetadata:\n  name: a"
+	testDocB = "apiVersion: v1\nkind: Service\nmetadata:\n  name: b"
+)
+
+func TestScannerLastDocument(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+	}{
+		{"no trailing newline", testDocA + "\n---\n" + testDocB},
+		{"trailing newline", testDocA + "\n---\n" + testDocB + "\n"},
+		{"separator without newline", testDocA + "\n---\n" + testDocB + "\n---"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := scanDocuments(t, tt.input)
+			want := []string{testDocA, testDocB}
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("got %q, want %q", got, want)
+			}
+		})
+	}
+}
+
+func TestProcessLastDocumentWithoutNewline(t *testing.T) {
+	files := build(t, testDocA+"\n---\n"+testDocB)
+	for _, name := range []string{"a.yaml", "b.yaml"} {
+		if _, ok := files[name]; !ok {
+			t.Errorf("missing %s", name)
+		}
+	}
+	if got := files["b.yaml"]; got != testDocB {
+		t.Errorf("got %q, want %q", got, testDocB)
+	}
+}
+
+func TestScannerTrailingSeparator(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+	}{
+		{"separator and newline", testDocA + "\n---\n"},
+		{"separator", testDocA + "\n---"},
+		{"separator and blank lines", testDocA + "\n---\n\n   \n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := scanDocuments(t, tt.input)
+			want := []string{testDocA}
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("got %q, want %q", got, want)
+			}
+
+			files := build(t, tt.input)
+			if len(files) != 2 || files["service.yaml"] != testDocA {
+				t.Errorf("unexpected output %q", files)
+			}
+		})
+	}
+}
+
+// sizedConfigMap returns a ConfigMap document of exactly size bytes, its
+// value under key padded to fit.
+func sizedConfigMap(t *testing.T, size int, trailingNewline bool) (doc, value string) {
+	t.Helper()
+	header := "apiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: big\ndata:\n  key: "
+	padding := size - len(header)
+	if trailingNewline {
+		padding--
+	}
+	value = strings.Repeat("x", padding)
+	doc = header + value
+	if trailingNewline {
+		doc += "\n"
+	}
+	if len(doc) != size {
+		t.Fatalf("document is %d bytes, want %d", len(doc), size)
+	}
+	return doc, value
+}
+
+func TestScannerSingleDocument(t *testing.T) {
+	for _, size := range []int{200, 4095, 4096, 4097} {
+		for _, trailingNewline := range []bool{false, true} {
+			doc, value := sizedConfigMap(t, size, trailingNewline)
+			got := scanDocuments(t, doc)
+			if want := []string{strings.TrimSpace(doc)}; !reflect.DeepEqual(got, want) {
+				t.Errorf("size %d, trailing newline %v: got %d documents, want the whole document", size, trailingNewline, len(got))
+				continue
+			}
+
+			files := build(t, doc)
+			if files["key"] != value {
+				t.Errorf("size %d, trailing newline %v: got value of %d bytes, want %d", size, trailingNewline, len(files["key"]), len(value))
+			}
+		}
+	}
+}
+
+const testEmbeddedSeparators = `apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: manifests
+data:
+  all.yaml: |
+    kind: A
+    ---
+    kind: B
+  README.md: |
+    # Title
+    ----
+    text
+`
+
+func TestScannerEmbeddedSeparator(t *testing.T) {
+	input := testEmbeddedSeparators + "---\n" + testDocA
+	got := scanDocuments(t, input)
+	want := []string{strings.TrimSpace(testEmbeddedSeparators), testDocA}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	files := build(t, input)
+	checkContains(t, files, "all.yaml", "kind: A\n---\nkind: B")
+	checkContains(t, files, "README.md", "# Title\n----\ntext")
+	checkContains(t, files, "service.yaml", "name: a")
+}